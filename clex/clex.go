@@ -0,0 +1,553 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package clex provides a lexer for the C programming language that splits
+source code into preprocessing tokens as defined by the C11 standard (6.4),
+such as identifiers, numbers, punctuators and literals. It is built on the
+ctext scanner, which is used to separate the comments and literals from the
+rest of the source.
+*/
+package clex
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jlubawy/go-ctext"
+	"github.com/jlubawy/go-ctext/internal"
+)
+
+// A TokenType is the type of token.
+type TokenType int
+
+const (
+	// ErrorToken is an error token type. The error can be retrieved by
+	// calling the scanner.Err() method.
+	ErrorToken TokenType = iota
+	// IdentifierToken is an identifier or keyword (e.g. "main" or "int").
+	IdentifierToken
+	// NumberToken is a preprocessing number (e.g. "42", "0x1p-3" or "1.0f").
+	NumberToken
+	// PunctuatorToken is a punctuator (e.g. "(", "->" or "##").
+	PunctuatorToken
+	// StringLiteralToken is a string literal including any prefix
+	// (e.g. u8"abc").
+	StringLiteralToken
+	// CharLiteralToken is a character constant including any prefix
+	// (e.g. L'a').
+	CharLiteralToken
+	// HeaderNameToken is a header name in an #include directive
+	// (e.g. <stdio.h> or "foo.h").
+	HeaderNameToken
+	// WhitespaceToken is a sequence of whitespace other than newlines,
+	// including any line splices.
+	WhitespaceToken
+	// NewlineToken is a newline.
+	NewlineToken
+	// CommentToken is a comment.
+	CommentToken
+	// OtherToken is a single character that cannot be part of any other
+	// token (e.g. '@').
+	OtherToken
+)
+
+var tokenTypeNames = []string{
+	ErrorToken:         "Error",
+	IdentifierToken:    "Identifier",
+	NumberToken:        "Number",
+	PunctuatorToken:    "Punctuator",
+	StringLiteralToken: "StringLiteral",
+	CharLiteralToken:   "CharLiteral",
+	HeaderNameToken:    "HeaderName",
+	WhitespaceToken:    "Whitespace",
+	NewlineToken:       "Newline",
+	CommentToken:       "Comment",
+	OtherToken:         "Other",
+}
+
+func (tt TokenType) String() string {
+	if tt >= 0 && int(tt) < len(tokenTypeNames) {
+		return tokenTypeNames[tt]
+	}
+	return fmt.Sprintf("TokenType(%d)", int(tt))
+}
+
+// MarshalText implements the encoding.TextMarshaler interface, so that token
+// types are encoded by name (e.g. in JSON).
+func (tt TokenType) MarshalText() ([]byte, error) {
+	return []byte(tt.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (tt *TokenType) UnmarshalText(text []byte) error {
+	for i, name := range tokenTypeNames {
+		if name == string(text) {
+			*tt = TokenType(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown token type %q", text)
+}
+
+// A Token is a single preprocessing token returned by the scanner.
+type Token struct {
+	Type     TokenType      // type of the token
+	Text     string         // text of the token, including any line splices
+	Position ctext.Position // position of the first byte of the token
+	End      ctext.Position // position immediately following the last byte of the token
+}
+
+// Spelling returns the text of the token with any line splices removed.
+func (tok Token) Spelling() string {
+	return internal.Unsplice(tok.Text)
+}
+
+// A Scanner is used to split a C source file into preprocessing tokens.
+type Scanner struct {
+	// Position is the position of the most recently scanned token within a
+	// file.
+	ctext.Position
+
+	// End is the position immediately following the most recently scanned
+	// token.
+	End ctext.Position
+
+	// Mode controls how the input is interpreted, only ctext.NestComments and
+	// ctext.CPlusPlus apply. It may be set before the first call to Next.
+	Mode ctext.Mode
+
+	r  io.Reader
+	cs *ctext.Scanner
+
+	err  error
+	tok  Token       // most recent token
+	toks []Token     // tokens lexed but not yet returned
+	text ctext.Token // adjacent text tokens not yet lexed, joined
+
+	lineStart bool // only whitespace and comments precede on the current line
+	directive int  // progress through a directive, see the constants below
+}
+
+const (
+	directiveNone   = iota
+	directiveName   // after a '#' at the start of a line
+	directiveHeader // after "#include", so a header name may follow
+)
+
+// NewScanner returns a pointer to a new C source lexer.
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{
+		r:         r,
+		lineStart: true,
+	}
+}
+
+// NewScannerFrom returns a pointer to a new C source lexer that reads from the
+// provided ctext scanner, using its Filename and Mode. The scanner's Mode is
+// changed to suit the lexer, so it must not have been used yet.
+func NewScannerFrom(cs *ctext.Scanner) *Scanner {
+	cs.Mode = cs.Mode&(ctext.NestComments|ctext.CPlusPlus) | ctext.ScanLiterals
+
+	s := NewScanner(nil)
+	s.Filename = cs.Filename
+	s.Mode = cs.Mode
+	s.cs = cs
+	return s
+}
+
+// Err returns the error associated with the most recent ErrorToken token.
+// This is typically io.EOF, meaning the end of tokenization.
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// Next returns the next token type to be processed.
+func (s *Scanner) Next() TokenType {
+	if s.cs == nil {
+		s.cs = ctext.NewScanner(s.r)
+		s.cs.Filename = s.Filename
+		s.cs.Mode = s.Mode&(ctext.NestComments|ctext.CPlusPlus) | ctext.ScanLiterals
+	}
+
+	for s.err == nil && !s.ready() {
+		s.fill()
+	}
+
+	if len(s.toks) == 0 {
+		s.tok = Token{Type: ErrorToken}
+		return ErrorToken
+	}
+
+	s.tok, s.toks = s.toks[0], s.toks[1:]
+	s.Position = s.tok.Position
+	s.End = s.tok.End
+	return s.tok.Type
+}
+
+// TokenText returns the string corresponding to the most recently scanned
+// token. Valid after calling Next().
+func (s *Scanner) TokenText() string {
+	return s.tok.Text
+}
+
+// Token returns the most recently scanned token. Valid after calling Next().
+func (s *Scanner) Token() Token {
+	return s.tok
+}
+
+// ready returns true if the next token can be returned. An identifier that
+// may be the prefix of a literal is held until the following token is known.
+func (s *Scanner) ready() bool {
+	switch len(s.toks) {
+	case 0:
+		return false
+	case 1:
+		return !isPrefix(s.toks[0])
+	}
+	return true
+}
+
+// fill lexes the next ctext token into the pending tokens. The ctext scanner
+// ends text tokens at each '/' in case it starts a comment, so adjacent text
+// tokens are joined before being lexed, otherwise tokens containing a '/'
+// (e.g. "/=" or <sys/types.h>) would be split.
+func (s *Scanner) fill() {
+	tt := s.cs.Next()
+	tok := s.cs.Token()
+
+	if tt == ctext.TextToken {
+		if s.text.Text == "" {
+			s.text = tok
+		} else {
+			s.text.Text += tok.Text
+			s.text.End = tok.End
+		}
+		return
+	}
+	if s.text.Text != "" {
+		s.lexText(s.text)
+		s.text = ctext.Token{}
+	}
+
+	switch tt {
+	case ctext.ErrorToken:
+		s.err = s.cs.Err()
+
+	case ctext.StringLiteralToken, ctext.CharLiteralToken:
+		s.lexLiteral(tok)
+
+	default:
+		if tt.IsComment() {
+			// Line comments include the newline ending them, which is
+			// returned separately.
+			text := strings.TrimSuffix(tok.Text, "\n")
+			if text != tok.Text {
+				text = strings.TrimSuffix(text, "\r")
+			}
+			end := advance(tok.Position, text)
+			s.push(Token{CommentToken, text, tok.Position, end})
+			if len(text) < len(tok.Text) {
+				s.push(Token{NewlineToken, tok.Text[len(text):], end, tok.End})
+			}
+		}
+	}
+}
+
+// push adds a token to the pending tokens, tracking whether it is part of a
+// directive.
+func (s *Scanner) push(tok Token) {
+	switch tok.Type {
+	case NewlineToken:
+		s.lineStart = true
+		s.directive = directiveNone
+
+	case WhitespaceToken, CommentToken:
+		// don't affect directives
+
+	default:
+		spelling := tok.Spelling()
+		if s.lineStart && tok.Type == PunctuatorToken && (spelling == "#" || spelling == "%:") {
+			s.directive = directiveName
+		} else if s.directive == directiveName && tok.Type == IdentifierToken &&
+			(spelling == "include" || spelling == "include_next" || spelling == "import") {
+			s.directive = directiveHeader
+		} else {
+			s.directive = directiveNone
+		}
+		s.lineStart = false
+	}
+
+	s.toks = append(s.toks, tok)
+}
+
+// lexLiteral adds a string or character literal token, merging it with any
+// encoding prefix preceding it.
+func (s *Scanner) lexLiteral(ctok ctext.Token) {
+	tok := Token{StringLiteralToken, ctok.Text, ctok.Position, ctok.End}
+	if ctok.Type == ctext.CharLiteralToken {
+		tok.Type = CharLiteralToken
+	}
+
+	if n := len(s.toks); n > 0 {
+		last := s.toks[n-1]
+		if isPrefix(last) && last.End.Offset == tok.Position.Offset && s.isPrefixOf(last.Spelling(), tok.Type) {
+			s.toks = s.toks[:n-1]
+			tok.Text = last.Text + tok.Text
+			tok.Position = last.Position
+		}
+	}
+
+	if tok.Type == StringLiteralToken && s.directive == directiveHeader {
+		tok.Type = HeaderNameToken
+	}
+	s.push(tok)
+}
+
+// lexText splits a text token into preprocessing tokens.
+func (s *Scanner) lexText(ctok ctext.Token) {
+	var (
+		text = ctok.Text
+		pos  = ctok.Position
+	)
+	for i := 0; i < len(text); {
+		n, tt := s.lexOne(text[i:])
+		end := advance(pos, text[i:i+n])
+		s.push(Token{tt, text[i : i+n], pos, end})
+		pos = end
+		i += n
+	}
+}
+
+// lexOne returns the length and type of the token at the start of t.
+func (s *Scanner) lexOne(t string) (n int, tt TokenType) {
+	switch c := t[0]; {
+	case c == '\n':
+		return 1, NewlineToken
+
+	case strings.HasPrefix(t, "\r\n"):
+		return 2, NewlineToken
+
+	case isSpace(c) || internal.SpliceLen(t) > 0:
+		for n < len(t) && !strings.HasPrefix(t[n:], "\r\n") {
+			if isSpace(t[n]) {
+				n += 1
+			} else if m := internal.SpliceLen(t[n:]); m > 0 {
+				n += m
+			} else {
+				break
+			}
+		}
+		return n, WhitespaceToken
+
+	case c == '<' && s.directive == directiveHeader:
+		if j := strings.IndexAny(t, ">\n"); j != -1 && t[j] == '>' {
+			return j + 1, HeaderNameToken
+		}
+	}
+
+	if n = s.numberLen(t); n > 0 {
+		return n, NumberToken
+	}
+	if n = identLen(t); n > 0 {
+		return n, IdentifierToken
+	}
+	if n = s.punctuatorLen(t); n > 0 {
+		return n, PunctuatorToken
+	}
+	return 1, OtherToken
+}
+
+// at returns the byte at offset i of t after skipping any line splices, and
+// the offset following it. ok is false if there are no more bytes.
+func at(t string, i int) (b byte, next int, ok bool) {
+	for i < len(t) {
+		n := internal.SpliceLen(t[i:])
+		if n == 0 {
+			return t[i], i + 1, true
+		}
+		i += n
+	}
+	return 0, i, false
+}
+
+// identLen returns the length of the identifier at the start of t, or zero if
+// there isn't one.
+func identLen(t string) (n int) {
+	for {
+		b, i, ok := at(t, n)
+		if !ok {
+			return
+		}
+		if m := ucnLen(t[n:]); m > 0 {
+			i = n + m
+		} else if !isIdent(b) || (n == 0 && internal.IsDigit(b)) {
+			return
+		}
+		n = i
+	}
+}
+
+// ucnLen returns the length of the universal character name (e.g. \u00e9) at
+// the start of t, or zero if there isn't one.
+func ucnLen(t string) int {
+	var n int
+	switch {
+	case strings.HasPrefix(t, `\u`):
+		n = 6
+	case strings.HasPrefix(t, `\U`):
+		n = 10
+	default:
+		return 0
+	}
+	if len(t) < n {
+		return 0
+	}
+	for i := 2; i < n; i++ {
+		if !isHex(t[i]) {
+			return 0
+		}
+	}
+	return n
+}
+
+// numberLen returns the length of the preprocessing number at the start of t,
+// or zero if there isn't one.
+func (s *Scanner) numberLen(t string) (n int) {
+	b, i, ok := at(t, 0)
+	if !ok {
+		return
+	}
+	if b == '.' {
+		if b, i, ok = at(t, i); !ok || !internal.IsDigit(b) {
+			return
+		}
+	} else if !internal.IsDigit(b) {
+		return
+	}
+	n = i
+
+	for {
+		b, i, ok := at(t, n)
+		if !ok {
+			return
+		}
+
+		switch {
+		case b == 'e' || b == 'E' || b == 'p' || b == 'P':
+			// An exponent may be followed by a sign
+			if c, j, ok := at(t, i); ok && (c == '+' || c == '-') {
+				i = j
+			}
+
+		case b == '\'' && s.Mode&ctext.CPlusPlus != 0:
+			// A digit separator must be followed by a digit or nondigit
+			c, j, ok := at(t, i)
+			if !ok || !isIdent(c) {
+				return
+			}
+			i = j
+
+		case b == '.' || isIdent(b):
+
+		default:
+			return
+		}
+		n = i
+	}
+}
+
+// punctuatorLen returns the length of the longest punctuator at the start of
+// t, or zero if there isn't one.
+func (s *Scanner) punctuatorLen(t string) int {
+	var (
+		bs   = make([]byte, 0, 4)
+		ends = make([]int, 0, 4)
+	)
+	for i := 0; len(bs) < 4; {
+		b, j, ok := at(t, i)
+		if !ok {
+			break
+		}
+		bs, ends = append(bs, b), append(ends, j)
+		i = j
+	}
+
+	for n := len(bs); n > 0; n-- {
+		p := string(bs[:n])
+		if punctuators[p] || (s.Mode&ctext.CPlusPlus != 0 && cppPunctuators[p]) {
+			return ends[n-1]
+		}
+	}
+	return 0
+}
+
+// punctuators are the punctuators of C11 6.4.6.
+var punctuators = map[string]bool{
+	"[": true, "]": true, "(": true, ")": true, "{": true, "}": true,
+	".": true, "->": true, "++": true, "--": true, "&": true, "*": true,
+	"+": true, "-": true, "~": true, "!": true, "/": true, "%": true,
+	"<<": true, ">>": true, "<": true, ">": true, "<=": true, ">=": true,
+	"==": true, "!=": true, "^": true, "|": true, "&&": true, "||": true,
+	"?": true, ":": true, ";": true, "...": true, "=": true, "*=": true,
+	"/=": true, "%=": true, "+=": true, "-=": true, "<<=": true, ">>=": true,
+	"&=": true, "^=": true, "|=": true, ",": true, "#": true, "##": true,
+	"<:": true, ":>": true, "<%": true, "%>": true, "%:": true, "%:%:": true,
+}
+
+// cppPunctuators are the additional punctuators of C++.
+var cppPunctuators = map[string]bool{
+	"::": true, ".*": true, "->*": true, "<=>": true,
+}
+
+// isPrefix returns true if the token may be the encoding prefix of a literal.
+func isPrefix(tok Token) bool {
+	if tok.Type != IdentifierToken {
+		return false
+	}
+	switch tok.Spelling() {
+	case "L", "u", "U", "u8", "R", "LR", "uR", "UR", "u8R":
+		return true
+	}
+	return false
+}
+
+// isPrefixOf returns true if the prefix is valid for the type of literal.
+func (s *Scanner) isPrefixOf(prefix string, tt TokenType) bool {
+	switch prefix {
+	case "L", "u", "U", "u8":
+		return true
+	}
+	return tt == StringLiteralToken && s.Mode&ctext.CPlusPlus != 0 && internal.IsRawStringPrefix([]byte(prefix))
+}
+
+// advance returns the position following the text, starting from pos.
+func advance(pos ctext.Position, text string) ctext.Position {
+	pos.Offset += len(text)
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			pos.Line += 1
+			pos.Column = 1
+		} else {
+			pos.Column += 1
+		}
+	}
+	return pos
+}
+
+// isIdent returns true if the byte may appear in an identifier, including '$'
+// and the bytes of UTF-8 encoded characters as allowed by most compilers.
+func isIdent(b byte) bool {
+	return internal.IsIdent(b) || b == '$' || b >= 0x80
+}
+
+func isHex(b byte) bool {
+	return internal.IsDigit(b) || 'a' <= b && b <= 'f' || 'A' <= b && b <= 'F'
+}
+
+// isSpace returns true if the byte is whitespace other than a newline.
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\v' || b == '\f' || b == '\r'
+}
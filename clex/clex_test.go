@@ -0,0 +1,264 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clex
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jlubawy/go-ctext"
+)
+
+// tok is a token without its positions.
+type tok struct {
+	Type TokenType
+	Text string
+}
+
+func scanAll(t *testing.T, input string, mode ctext.Mode) (toks []Token) {
+	s := NewScanner(strings.NewReader(input))
+	s.Mode = mode
+	for s.Next() != ErrorToken {
+		toks = append(toks, s.Token())
+	}
+	if err := s.Err(); err != io.EOF {
+		t.Errorf("unexpected error: %v", err)
+	}
+	return
+}
+
+func TestScanner(t *testing.T) {
+	var cases = []struct {
+		Input    string
+		Mode     ctext.Mode
+		Expected []tok
+	}{
+		{
+			Input: "int x=0x1Fu;",
+			Expected: []tok{
+				{IdentifierToken, "int"},
+				{WhitespaceToken, " "},
+				{IdentifierToken, "x"},
+				{PunctuatorToken, "="},
+				{NumberToken, "0x1Fu"},
+				{PunctuatorToken, ";"},
+			},
+		},
+		{
+			Input: "a+++b->c<<=.5e-3 1.0p+2f...",
+			Expected: []tok{
+				{IdentifierToken, "a"},
+				{PunctuatorToken, "++"},
+				{PunctuatorToken, "+"},
+				{IdentifierToken, "b"},
+				{PunctuatorToken, "->"},
+				{IdentifierToken, "c"},
+				{PunctuatorToken, "<<="},
+				{NumberToken, ".5e-3"},
+				{WhitespaceToken, " "},
+				{NumberToken, "1.0p+2f..."},
+			},
+		},
+		{
+			Input: "%:define CAT(a,b) a%:%:b <:1:>",
+			Expected: []tok{
+				{PunctuatorToken, "%:"},
+				{IdentifierToken, "define"},
+				{WhitespaceToken, " "},
+				{IdentifierToken, "CAT"},
+				{PunctuatorToken, "("},
+				{IdentifierToken, "a"},
+				{PunctuatorToken, ","},
+				{IdentifierToken, "b"},
+				{PunctuatorToken, ")"},
+				{WhitespaceToken, " "},
+				{IdentifierToken, "a"},
+				{PunctuatorToken, "%:%:"},
+				{IdentifierToken, "b"},
+				{WhitespaceToken, " "},
+				{PunctuatorToken, "<:"},
+				{NumberToken, "1"},
+				{PunctuatorToken, ":>"},
+			},
+		},
+		{
+			Input: "s = L\"wide\" u8\"utf8\" 'c' U'\\n' @;\r\n",
+			Expected: []tok{
+				{IdentifierToken, "s"},
+				{WhitespaceToken, " "},
+				{PunctuatorToken, "="},
+				{WhitespaceToken, " "},
+				{StringLiteralToken, "L\"wide\""},
+				{WhitespaceToken, " "},
+				{StringLiteralToken, "u8\"utf8\""},
+				{WhitespaceToken, " "},
+				{CharLiteralToken, "'c'"},
+				{WhitespaceToken, " "},
+				{CharLiteralToken, "U'\\n'"},
+				{WhitespaceToken, " "},
+				{OtherToken, "@"},
+				{PunctuatorToken, ";"},
+				{NewlineToken, "\r\n"},
+			},
+		},
+		{
+			Input: "#include <stdio.h>\n # include \"foo.h\" // comment\nx<y>z",
+			Expected: []tok{
+				{PunctuatorToken, "#"},
+				{IdentifierToken, "include"},
+				{WhitespaceToken, " "},
+				{HeaderNameToken, "<stdio.h>"},
+				{NewlineToken, "\n"},
+				{WhitespaceToken, " "},
+				{PunctuatorToken, "#"},
+				{WhitespaceToken, " "},
+				{IdentifierToken, "include"},
+				{WhitespaceToken, " "},
+				{HeaderNameToken, "\"foo.h\""},
+				{WhitespaceToken, " "},
+				{CommentToken, "// comment"},
+				{NewlineToken, "\n"},
+				{IdentifierToken, "x"},
+				{PunctuatorToken, "<"},
+				{IdentifierToken, "y"},
+				{PunctuatorToken, ">"},
+				{IdentifierToken, "z"},
+			},
+		},
+		{
+			Input: "#include <sys/types.h>\nx /= a/b;",
+			Expected: []tok{
+				{PunctuatorToken, "#"},
+				{IdentifierToken, "include"},
+				{WhitespaceToken, " "},
+				{HeaderNameToken, "<sys/types.h>"},
+				{NewlineToken, "\n"},
+				{IdentifierToken, "x"},
+				{WhitespaceToken, " "},
+				{PunctuatorToken, "/="},
+				{WhitespaceToken, " "},
+				{IdentifierToken, "a"},
+				{PunctuatorToken, "/"},
+				{IdentifierToken, "b"},
+				{PunctuatorToken, ";"},
+			},
+		},
+		{
+			Input: "in\\\nt \\\n x/**/=\\u00e9;",
+			Expected: []tok{
+				{IdentifierToken, "in\\\nt"},
+				{WhitespaceToken, " \\\n "},
+				{IdentifierToken, "x"},
+				{CommentToken, "/**/"},
+				{PunctuatorToken, "="},
+				{IdentifierToken, "\\u00e9"},
+				{PunctuatorToken, ";"},
+			},
+		},
+
+		// C++
+		{
+			Input: "a::b<=>1'000'000 R\"x(\")x\" u8R\"(r)\"",
+			Mode:  ctext.CPlusPlus,
+			Expected: []tok{
+				{IdentifierToken, "a"},
+				{PunctuatorToken, "::"},
+				{IdentifierToken, "b"},
+				{PunctuatorToken, "<=>"},
+				{NumberToken, "1'000'000"},
+				{WhitespaceToken, " "},
+				{StringLiteralToken, "R\"x(\")x\""},
+				{WhitespaceToken, " "},
+				{StringLiteralToken, "u8R\"(r)\""},
+			},
+		},
+		{
+			Input: "a::b<=>c",
+			Expected: []tok{
+				{IdentifierToken, "a"},
+				{PunctuatorToken, ":"},
+				{PunctuatorToken, ":"},
+				{IdentifierToken, "b"},
+				{PunctuatorToken, "<="},
+				{PunctuatorToken, ">"},
+				{IdentifierToken, "c"},
+			},
+		},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test Case: %d", i)
+
+		var actual []tok
+		for _, token := range scanAll(t, tc.Input, tc.Mode) {
+			actual = append(actual, tok{token.Type, token.Text})
+		}
+		if !reflect.DeepEqual(tc.Expected, actual) {
+			t.Error("data mismatch")
+			t.Errorf("%v", tc.Expected)
+			t.Errorf("%v", actual)
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	var input = "a = b;\n  L\"c\\\nd\" /* x */ e"
+
+	var expected = []Token{
+		{IdentifierToken, "a", testPos(0, 1, 1), testPos(1, 1, 2)},
+		{WhitespaceToken, " ", testPos(1, 1, 2), testPos(2, 1, 3)},
+		{PunctuatorToken, "=", testPos(2, 1, 3), testPos(3, 1, 4)},
+		{WhitespaceToken, " ", testPos(3, 1, 4), testPos(4, 1, 5)},
+		{IdentifierToken, "b", testPos(4, 1, 5), testPos(5, 1, 6)},
+		{PunctuatorToken, ";", testPos(5, 1, 6), testPos(6, 1, 7)},
+		{NewlineToken, "\n", testPos(6, 1, 7), testPos(7, 2, 1)},
+		{WhitespaceToken, "  ", testPos(7, 2, 1), testPos(9, 2, 3)},
+		{StringLiteralToken, "L\"c\\\nd\"", testPos(9, 2, 3), testPos(16, 3, 3)},
+		{WhitespaceToken, " ", testPos(16, 3, 3), testPos(17, 3, 4)},
+		{CommentToken, "/* x */", testPos(17, 3, 4), testPos(24, 3, 11)},
+		{WhitespaceToken, " ", testPos(24, 3, 11), testPos(25, 3, 12)},
+		{IdentifierToken, "e", testPos(25, 3, 12), testPos(26, 3, 13)},
+	}
+
+	actual := scanAll(t, input, 0)
+	if !reflect.DeepEqual(expected, actual) {
+		t.Error("data mismatch")
+		for i := 0; i < len(expected) || i < len(actual); i++ {
+			var e, a Token
+			if i < len(expected) {
+				e = expected[i]
+			}
+			if i < len(actual) {
+				a = actual[i]
+			}
+			if e != a {
+				t.Errorf("%d: expected %+v but got %+v", i, e, a)
+			}
+		}
+	}
+}
+
+func TestSpelling(t *testing.T) {
+	tok := Token{Type: IdentifierToken, Text: "in\\\nclude"}
+	if s := tok.Spelling(); s != "include" {
+		t.Errorf("expected %q but got %q", "include", s)
+	}
+}
+
+func TestUnterminatedComment(t *testing.T) {
+	s := NewScanner(strings.NewReader("a /* b"))
+	for s.Next() != ErrorToken {
+	}
+	if err := s.Err(); err == nil || err == io.EOF {
+		t.Errorf("expected error but got %v", err)
+	}
+}
+
+// testPos returns a position without a filename.
+func testPos(offset, line, column int) ctext.Position {
+	return ctext.Position{Offset: offset, Line: line, Column: column}
+}
@@ -0,0 +1,46 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clex_test
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/jlubawy/go-ctext/clex"
+)
+
+func Example() {
+	s := clex.NewScanner(strings.NewReader("#include <stdio.h>\nputs(\"hi\"); // greet\n"))
+	s.Filename = "hello.c"
+	for {
+		tt := s.Next()
+		switch tt {
+		case clex.ErrorToken:
+			if err := s.Err(); err != io.EOF {
+				log.Fatal(err)
+			}
+			return
+
+		case clex.WhitespaceToken, clex.NewlineToken:
+			// skip
+
+		default:
+			fmt.Printf("%s: %-13s %s\n", s.Position, tt, s.TokenText())
+		}
+	}
+
+	// Output:
+	// hello.c:1:1: Punctuator    #
+	// hello.c:1:2: Identifier    include
+	// hello.c:1:10: HeaderName    <stdio.h>
+	// hello.c:2:1: Identifier    puts
+	// hello.c:2:5: Punctuator    (
+	// hello.c:2:6: StringLiteral "hi"
+	// hello.c:2:10: Punctuator    )
+	// hello.c:2:11: Punctuator    ;
+	// hello.c:2:13: Comment       // greet
+}
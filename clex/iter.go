@@ -0,0 +1,32 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+// +build go1.23
+
+package clex
+
+import (
+	"io"
+	"iter"
+)
+
+// All returns an iterator over the remaining tokens of the scanner. Iteration
+// stops at the end of the input. Any other error is yielded once with an
+// ErrorToken before iteration stops.
+func (s *Scanner) All() iter.Seq2[Token, error] {
+	return func(yield func(Token, error) bool) {
+		for {
+			if s.Next() == ErrorToken {
+				if err := s.Err(); err != io.EOF {
+					yield(s.Token(), err)
+				}
+				return
+			}
+			if !yield(s.Token(), nil) {
+				return
+			}
+		}
+	}
+}
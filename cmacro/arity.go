@@ -0,0 +1,182 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmacro
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jlubawy/go-ctext"
+	"github.com/jlubawy/go-ctext/clex"
+)
+
+// An Arity is the number of arguments accepted by a function-like macro.
+type Arity struct {
+	Params   int  // number of parameters, not including the variable arguments
+	Variadic bool // true if any number of variable arguments may follow
+}
+
+// String returns the number of parameters, followed by a '+' if the macro is
+// variadic (e.g. "1+" for LOG(fmt, ...)).
+func (a Arity) String() string {
+	s := strconv.Itoa(a.Params)
+	if a.Variadic {
+		s += "+"
+	}
+	return s
+}
+
+// ParseArity parses an arity in the form returned by Arity.String.
+func ParseArity(s string) (a Arity, err error) {
+	n := strings.TrimSuffix(s, "+")
+	a.Variadic = n != s
+	a.Params, err = strconv.Atoi(n)
+	if err != nil || a.Params < 0 {
+		err = fmt.Errorf("invalid arity %q", s)
+	}
+	return
+}
+
+// Accepts returns true if the number of arguments, as in Invocation.NumArgs,
+// is accepted.
+func (a Arity) Accepts(n int) bool {
+	if n == 0 && a.Params == 1 {
+		// An empty argument list is a single empty argument (e.g. "F()")
+		return true
+	}
+	if a.Variadic {
+		// The variable arguments may be omitted
+		return n >= a.Params
+	}
+	return n == a.Params
+}
+
+// Arity returns the arity of a function-like macro, or false if the
+// definition is an #undef or an object-like macro.
+func (def Definition) Arity() (a Arity, ok bool) {
+	if def.Undef || !def.FunctionLike {
+		return
+	}
+	a.Params = len(def.Params)
+	if def.Variadic {
+		a.Params -= 1
+		a.Variadic = true
+	}
+	return a, true
+}
+
+// An ArityError is an invocation with the wrong number of arguments.
+type ArityError struct {
+	Invocation Invocation
+	Arity      Arity
+}
+
+func (e *ArityError) Error() string {
+	var (
+		inv = e.Invocation
+		n   = inv.NumArgs
+	)
+	if e.Arity.Variadic {
+		return fmt.Sprintf("%s: macro %q requires at least %d arguments, but only %d given", inv.Pos, inv.Name, e.Arity.Params, n)
+	}
+	return fmt.Sprintf("%s: macro %q requires %d arguments, but %d given", inv.Pos, inv.Name, e.Arity.Params, n)
+}
+
+// A Validator checks that macro invocations have the number of arguments
+// accepted by the macros.
+type Validator struct {
+	arities map[string]Arity
+}
+
+// NewValidator returns a pointer to a new validator without any macros.
+func NewValidator() *Validator {
+	return &Validator{
+		arities: make(map[string]Arity),
+	}
+}
+
+// Define sets the arity of the macro from its definition, or removes the
+// macro for an #undef or object-like macro.
+func (v *Validator) Define(def Definition) {
+	if a, ok := def.Arity(); ok {
+		v.arities[def.Name] = a
+	} else {
+		delete(v.arities, def.Name)
+	}
+}
+
+// SetArity sets the arity of the named macro.
+func (v *Validator) SetArity(name string, a Arity) {
+	v.arities[name] = a
+}
+
+// ReadArities reads the arities of macros, one per line as a name and arity
+// separated by whitespace (e.g. "LOG 1+"). Blank lines and lines starting
+// with '#' are ignored.
+func (v *Validator) ReadArities(r io.Reader) (err error) {
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d: expected a name and arity", line)
+		}
+
+		var a Arity
+		a, err = ParseArity(fields[1])
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		v.SetArity(fields[0], a)
+	}
+	return s.Err()
+}
+
+// Names returns the names of the macros in sorted order.
+func (v *Validator) Names() (names []string) {
+	for name := range v.arities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Check returns an *ArityError if the invocation is of a known macro and has
+// the wrong number of arguments, otherwise nil.
+func (v *Validator) Check(inv Invocation) error {
+	a, ok := v.arities[inv.Name]
+	if !ok || a.Accepts(inv.NumArgs) {
+		return nil
+	}
+	return &ArityError{Invocation: inv, Arity: a}
+}
+
+// Validate scans the provided scanner for invocations of the known macros,
+// returning each with the wrong number of arguments via the provided
+// callback. The #define and #undef directives within the source are added to
+// the validator as they are scanned, so they only apply to the invocations
+// following them.
+func (v *Validator) Validate(s *ctext.Scanner, errFunc func(err *ArityError)) (err error) {
+	known := func(name string) bool {
+		_, ok := v.arities[name]
+		return ok
+	}
+	return scanInvocations(clex.NewScannerFrom(s), known, func(inv Invocation) {
+		if err := v.Check(inv); err != nil {
+			errFunc(err.(*ArityError))
+		}
+	}, v.Define)
+}
+
+// ValidateString is like Validate but scans the provided string.
+func (v *Validator) ValidateString(s string, errFunc func(err *ArityError)) (err error) {
+	return v.Validate(ctext.NewScanner(strings.NewReader(s)), errFunc)
+}
@@ -5,55 +5,175 @@
 /*
 Package cmacro provides a scanner for the C programming language that returns
 function-like macro invocations. This may be useful to other programs
-that need to scan a program for specific macro invocation
+that need to scan a program for specific macro invocation. Other references to
+macros, such as object-like macros or taking the address of a function, may be
+found with ScanIdentifiers, and the definitions of macros with ScanDefinitions.
+The definitions may be used to expand invocations with an Expander, or to check
+the number of arguments of invocations with a Validator.
 */
 package cmacro
 
 import (
-	"bytes"
-	"errors"
 	"fmt"
 	"io"
-	"regexp"
+	"os"
 	"strings"
 
 	"github.com/jlubawy/go-ctext"
-	"github.com/jlubawy/go-ctext/internal"
+	"github.com/jlubawy/go-ctext/clex"
 )
 
 // An Invocation is an invocation of a function-like macro within C source code.
 type Invocation struct {
 	Name       string   // name of the macro invocation
 	Start, End int      // lines that the macro invocation starts and ends on
-	Args       []string // arguments to the macro invocation if any
+	Args       []string // text of the arguments to the macro invocation if any, not including empty arguments
+	NumArgs    int      // number of arguments including empty ones (e.g. 3 for "F(a,,b)"), zero for "F()"
+
+	Pos        ctext.Position // position of the start of the macro invocation, which is its name
+	Lparen     ctext.Position // position of the opening parenthesis
+	Rparen     ctext.Position // position of the matching closing parenthesis
+	Terminator ctext.Position // position of the terminating semi-colon, if any (see IsValid)
+	EndPos     ctext.Position // position immediately following the terminating semi-colon, or else the closing parenthesis
+	Arguments  []Argument     // arguments with their positions including empty ones, one per parameter (see NumArgs)
+
+	// Follow is the rest of the line following the closing parenthesis,
+	// without leading and trailing whitespace, giving the context of the
+	// invocation (e.g. ";" for a statement, "{" for a statement-like macro or
+	// "," in an initializer).
+	Follow string
+}
+
+// An Argument is an argument to a macro invocation.
+type Argument struct {
+	Text    string         // text of the argument as in Invocation.Args, without line endings, or empty
+	Raw     string         // text of the argument exactly as in the source, between the delimiters
+	Trimmed string         // text of the argument as in the source, without leading and trailing whitespace
+	Pos     ctext.Position // position of the first byte of the trimmed argument, or RawPos if it's empty
+	End     ctext.Position // position immediately following the last byte of the trimmed argument, or RawPos if it's empty
+	RawPos  ctext.Position // position of the first byte of the raw argument
+	RawEnd  ctext.Position // position immediately following the last byte of the raw argument
 }
 
 func (inv Invocation) String() string {
-	return fmt.Sprintf("%s( %s );", inv.Name, strings.Join(inv.Args, ", "))
+	s := fmt.Sprintf("%s( %s )", inv.Name, strings.Join(inv.Args, ", "))
+	if inv.Terminator.IsValid() {
+		s += ";"
+	}
+	return s
 }
 
 // ScanInvocations scans the provided io.Reader for macro invocations that match
 // the given names, returning any via the provided callback.
 func ScanInvocations(r io.Reader, scanFunc func(inv Invocation), names ...string) (err error) {
-	s := ctext.NewScanner(r)
+	return ScanInvocationsScanner(ctext.NewScanner(r), scanFunc, names...)
+}
+
+// ScanInvocationsScanner is like ScanInvocations but reads from the provided
+// scanner, so that its Mode (e.g. ctext.CPlusPlus) and Filename may be set.
+// Preprocessor directives, including macro definitions, are skipped, as are
+// comments and string literals.
+func ScanInvocationsScanner(s *ctext.Scanner, scanFunc func(inv Invocation), names ...string) (err error) {
+	want := make(map[string]bool, len(names))
+	for _, name := range names {
+		want[name] = true
+	}
+	return scanInvocations(clex.NewScannerFrom(s), func(name string) bool { return want[name] }, scanFunc, nil)
+}
+
+// scanInvocations scans for invocations of the macros whose names are
+// wanted, returning any via scanFunc. If defFunc isn't nil then it is called
+// with each #define and #undef directive, in order with the invocations.
+func scanInvocations(s *clex.Scanner, want func(name string) bool, scanFunc func(inv Invocation), defFunc func(def Definition)) (err error) {
+	var (
+		tr        = &tokenReader{s: s}
+		lineStart = true
+		directive []clex.Token // tokens of the current directive, if any
+	)
+
+	// endDirective passes the current directive to defFunc if it's a
+	// definition
+	endDirective := func() (err error) {
+		sig := significant(directive)
+		if defFunc != nil && len(sig) > 1 && sig[1].Type == clex.IdentifierToken && (sig[1].Spelling() == "define" || sig[1].Spelling() == "undef") {
+			var def Definition
+			def, err = parseDefinition(directive)
+			if err == nil {
+				defFunc(def)
+			}
+		}
+		directive = nil
+		return
+	}
+
 	for {
-		tt := s.Next()
-		switch tt {
-		case ctext.ErrorToken:
-			err = s.Err()
-			if err == io.EOF {
-				err = nil
+		tok, ok := tr.next()
+		if !ok {
+			err = endDirective()
+			if err == nil {
+				err = tr.Err()
 			}
 			return
+		}
 
-		case ctext.TextToken:
-			err = scanInvocationsTextToken(s.TokenText(), s.Position, scanFunc, names...)
+		switch {
+		case tok.Type == clex.NewlineToken:
+			err = endDirective()
 			if err != nil {
 				return
 			}
+			lineStart = true
+			continue
+
+		case directive != nil:
+			directive = append(directive, tok)
+			continue
+
+		case tok.Type == clex.WhitespaceToken || tok.Type == clex.CommentToken:
+			continue
+
+		case lineStart && tok.Type == clex.PunctuatorToken && (tok.Spelling() == "#" || tok.Spelling() == "%:"):
+			directive = []clex.Token{tok}
+			lineStart = false
+			continue
+		}
+
+		lineStart = false
+		if tok.Type != clex.IdentifierToken || !want(tok.Spelling()) {
+			continue
+		}
+
+		// Skip any use of the name that isn't an invocation (e.g. passing a
+		// function-like macro as a function pointer), which must be followed
+		// by the opening parentheses. ScanIdentifiers reports these.
+		i := tr.significant(0)
+		if lparen, ok := tr.peek(i); !ok || lparen.Text != "(" {
+			continue
+		}
+
+		var inv Invocation
+		inv, ok = scanInvocation(tr, tok, i)
+		if !ok {
+			// An unterminated invocation
+			return tr.Err()
 		}
+		scanFunc(inv)
 	}
-	return
+}
+
+// ScanInvocationsFile scans the named file for macro invocations that match the
+// given names, returning any via the provided callback. The positions of the
+// invocations include the filename.
+func ScanInvocationsFile(filename string, scanFunc func(inv Invocation), names ...string) (err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	s := ctext.NewScanner(f)
+	s.Filename = filename
+	return ScanInvocationsScanner(s, scanFunc, names...)
 }
 
 // ScanInvocationsString scans the provided string for macro invocations that
@@ -62,262 +182,183 @@ func ScanInvocationsString(s string, scanFunc func(inv Invocation), names ...str
 	return ScanInvocations(strings.NewReader(s), scanFunc, names...)
 }
 
-// scanInvocationsTextToken scans the provided text token for macro invocations
-// that match the given names, returning any via the provided callback.
-func scanInvocationsTextToken(s string, pos ctext.Position, scanFunc func(inv Invocation), names ...string) (err error) {
-	var re *regexp.Regexp
-	re, err = compileNamesRegexp(names...)
-	if err != nil {
-		return
+// scanInvocation scans the rest of an invocation of the macro whose name has
+// been read, where the opening parenthesis is the ith next token. ok is false
+// if the invocation isn't terminated.
+func scanInvocation(tr *tokenReader, name clex.Token, i int) (inv Invocation, ok bool) {
+	inv = Invocation{
+		Name:      name.Spelling(),
+		Args:      make([]string, 0),
+		Arguments: make([]Argument, 0),
+		Pos:       name.Position,
+		Start:     name.Position.Line,
 	}
+	var lparen clex.Token
+	for ; i >= 0; i-- {
+		lparen, _ = tr.next()
+	}
+	inv.Lparen = lparen.Position
 
 	var (
-		lineCurr = pos.Line
-		inv      Invocation
+		depth int
+		arg   []clex.Token // tokens of the current argument
+		start = lparen.End // position following the delimiter preceding the argument
 	)
 	for {
-		// Find the next instance of the macro name
-		loc := re.FindStringIndex(s)
-		if loc == nil {
-			goto DONE
+		var tok clex.Token
+		tok, ok = tr.next()
+		if !ok {
+			return
 		}
 
-		var (
-			ni   = loc[0]
-			name = s[loc[0]:loc[1]]
-		)
-
-		// Count all line-endings before this name
-		for i := 0; i < ni; i++ {
-			if s[i] == '\n' {
-				lineCurr += 1
+		switch {
+		case tok.Text == "(":
+			depth += 1
+		case tok.Text == ")" && depth > 0:
+			depth -= 1
+		case tok.Text == "," && depth == 0:
+			inv.addArg(arg, start, tok.Position)
+			arg, start = arg[:0], tok.End
+			continue
+		case tok.Text == ")":
+			inv.addArg(arg, start, tok.Position)
+			if inv.NumArgs == 1 && len(inv.Args) == 0 {
+				// An empty argument list
+				inv.NumArgs = 0
+				inv.Arguments = inv.Arguments[:0]
 			}
-		}
-
-		// Check if this is a macro definition and not an invocation
-		isDef := isMacroDefinition(s, ni)
-
-		// Shorten the string length to look after the name
-		s = s[ni+len(name):]
-
-		if isDef {
-			continue // skip if this was a definition
-		}
-
-		// Reset the local invocation
-		inv.Name = name
-		inv.Args = make([]string, 0)
-		inv.Start = lineCurr
-
-		// Find the opening parentheses
-		opi := strings.Index(s, "(")
-		if opi == -1 {
-			err = errors.New("macro function missing opening parentheses")
+			inv.Rparen = tok.Position
+			inv.EndPos = tok.End
+			inv.Follow = tr.followingLine()
+
+			// Include any terminating semi-colon
+			j := tr.significant(0)
+			if semi, ok := tr.peek(j); ok && semi.Text == ";" {
+				for ; j >= 0; j-- {
+					tr.next()
+				}
+				inv.Terminator = semi.Position
+				inv.EndPos = semi.End
+			}
+			inv.End = inv.EndPos.Line
 			return
 		}
+		arg = append(arg, tok)
+	}
+}
 
-		// Parse each character after the opening parentheses
-		var (
-			done            bool
-			inStringLiteral bool
-			parenCount      int
-			buf             = &bytes.Buffer{}
-		)
-
-		// Iterate over the rest of the characters
-		i := opi + 1
-		for ; (i < len(s)) && !done; i++ {
-			b := s[i]
-
-			switch b {
-			case ' ':
-				if inStringLiteral || parenCount > 0 {
-					// If in a string literal then add the space
-					err = buf.WriteByte(b)
-					if err != nil {
-						return
-					}
-				} else if parenCount == 0 {
-					// Else it's probably the end of an argument
-					arg, ok := parseInvocationArg(buf)
-					if ok {
-						inv.Args = append(inv.Args, strings.TrimSpace(string(arg)))
-					}
-				}
-
-			case ',':
-				if inStringLiteral || parenCount > 0 {
-					// If in a string literal add the comma
-					err = buf.WriteByte(b)
-					if err != nil {
-						return
-					}
-				} else if parenCount == 0 {
-					// Else it's probably the end of an argument
-					arg, ok := parseInvocationArg(buf)
-					if ok {
-						inv.Args = append(inv.Args, strings.TrimSpace(string(arg)))
-					}
-				}
-
-			case '"':
-				if inStringLiteral {
-					lb, ok := internal.LastByte(buf)
-					if ok && lb == '\\' {
-						// If in a string literal, but this quote was escaped
-						// then add it to the buffer
-						err = buf.WriteByte(b)
-						if err != nil {
-							return
-						}
-					} else {
-						// Else leaving a string literal, which has to be the end
-						// of an argument
-						inStringLiteral = false
-						err = buf.WriteByte(b)
-						if err != nil {
-							return
-						}
-						if parenCount == 0 {
-							arg, ok := parseInvocationArg(buf)
-							if ok {
-								inv.Args = append(inv.Args, strings.TrimSpace(string(arg)))
-							}
-						}
-					}
-				} else {
-					// Else not in a string literal, so we are now
-					inStringLiteral = true
-					err = buf.WriteByte(b)
-					if err != nil {
-						return
-					}
-				}
-
-			case '(':
-				// Add any opening paren
-				err = buf.WriteByte(b)
-				if err != nil {
-					return
-				}
-
-				if !inStringLiteral {
-					// Probably an invocation of a macro/func within an invocation
-					parenCount += 1
-				}
-
-			case ')':
-				if inStringLiteral {
-					// If in a string literal add the closing paren
-					err = buf.WriteByte(b)
-					if err != nil {
-						return
-					}
-				} else {
-					if parenCount > 0 {
-						// If inside another invocation add the closing paren
-						err = buf.WriteByte(b)
-						if err != nil {
-							return
-						}
-
-						// Only decrement if > 0
-						parenCount -= 1
-					}
-
-					if parenCount == 0 {
-						arg, ok := parseInvocationArg(buf)
-						if ok {
-							inv.Args = append(inv.Args, strings.TrimSpace(string(arg)))
-						}
-					}
-				}
+// addArg adds an argument with the tokens between the positions. Empty
+// arguments aren't added to Args.
+func (inv *Invocation) addArg(toks []clex.Token, start, end ctext.Position) {
+	inv.NumArgs += 1
+
+	var raw, text strings.Builder
+	for _, tok := range toks {
+		raw.WriteString(tok.Text)
+		switch tok.Type {
+		case clex.NewlineToken:
+			// discard line endings, although they are kept in the raw and
+			// trimmed arguments
+		case clex.CommentToken:
+			text.WriteByte(' ')
+		default:
+			text.WriteString(tok.Text)
+		}
+	}
+	arg := Argument{
+		Text:   strings.TrimSpace(text.String()),
+		Raw:    raw.String(),
+		Pos:    start,
+		End:    start,
+		RawPos: start,
+		RawEnd: end,
+	}
 
-			case ';':
-				if inStringLiteral {
-					// If in a string literal add the semi-colon
-					err = buf.WriteByte(b)
-					if err != nil {
-						return
-					}
-				} else {
-					// Else if not in a string literal, close out the invocation
-					// and find the next one.
-					inv.End = lineCurr
-					scanFunc(inv)
-					done = true
-				}
+	// Trim the leading and trailing whitespace
+	for len(toks) > 0 && isSpaceToken(toks[0]) {
+		toks = toks[1:]
+	}
+	for len(toks) > 0 && isSpaceToken(toks[len(toks)-1]) {
+		toks = toks[:len(toks)-1]
+	}
+	if len(toks) > 0 {
+		arg.Pos, arg.End = toks[0].Position, toks[len(toks)-1].End
+		arg.Trimmed = arg.Raw[arg.Pos.Offset-arg.RawPos.Offset : arg.End.Offset-arg.RawPos.Offset]
+	}
 
-			case '\r':
-				// discard carriage returns, wait for newline
+	if arg.Text != "" {
+		inv.Args = append(inv.Args, arg.Text)
+	}
+	inv.Arguments = append(inv.Arguments, arg)
+}
 
-			case '\n':
-				lineCurr += 1
+func isSpaceToken(tok clex.Token) bool {
+	return tok.Type == clex.WhitespaceToken || tok.Type == clex.NewlineToken
+}
 
-			default:
-				err = buf.WriteByte(b)
-				if err != nil {
-					return
-				}
-			}
-		}
+// A tokenReader reads tokens from a lexer, allowing tokens to be peeked at
+// before they are read.
+type tokenReader struct {
+	s    *clex.Scanner
+	toks []clex.Token // tokens peeked at but not yet read
+}
 
-		// If we've reached the end of the string break out of the outer loop
-		if i >= len(s) {
-			break
-		}
+// Err returns the error that ended the tokens, or nil at the end of the input.
+func (tr *tokenReader) Err() error {
+	if err := tr.s.Err(); err != io.EOF {
+		return err
 	}
-
-DONE:
-	return
+	return nil
 }
 
-func isMacroDefinition(s string, ni int) (isDef bool) {
-	if ni >= 8 {
-		i := ni - 1
-		for ; i >= 0; i-- {
-			if s[i] != ' ' {
-				break
-			}
-		}
-		if i >= 6 {
-			if s[i-5:i+1] == "define" {
-				for j := i - 6; j >= 0; j-- {
-					switch s[j] {
-					case ' ':
-						// skip spaces
-					case '#':
-						isDef = true
-						return
-					default:
-						return
-					}
-				}
-			}
+// peek returns the ith next token without reading it, ok is false if there
+// aren't that many tokens.
+func (tr *tokenReader) peek(i int) (tok clex.Token, ok bool) {
+	for len(tr.toks) <= i {
+		if tr.s.Next() == clex.ErrorToken {
+			return
 		}
+		tr.toks = append(tr.toks, tr.s.Token())
 	}
-	return
+	return tr.toks[i], true
 }
 
-// parseInvocationArg returns an argument string and shortens the buffer length to zero if
-// the provided buffer isn't empty.
-func parseInvocationArg(buf *bytes.Buffer) (arg string, ok bool) {
-	arg = strings.TrimSpace(buf.String())
-	if len(arg) > 0 {
-		ok = true
-		buf.Reset()
+// next reads the next token, ok is false if there are no more tokens.
+func (tr *tokenReader) next() (tok clex.Token, ok bool) {
+	tok, ok = tr.peek(0)
+	if ok {
+		tr.toks = tr.toks[1:]
 	}
 	return
 }
 
-// compileNamesRegexp takes a list of macro names and compiles a regexp to match
-// all of them.
-func compileNamesRegexp(names ...string) (re *regexp.Regexp, err error) {
-	ns := make([]string, len(names))
+// significant returns the index of the next token from the ith that isn't
+// whitespace, a newline or a comment, which may be beyond the end.
+func (tr *tokenReader) significant(i int) int {
+	for {
+		tok, ok := tr.peek(i)
+		if !ok || !(isSpaceToken(tok) || tok.Type == clex.CommentToken) {
+			return i
+		}
+		i += 1
+	}
+}
 
-	// Quote any meta characters since the names are searched as is
-	for i := 0; i < len(names); i++ {
-		ns[i] = "(\\b" + regexp.QuoteMeta(names[i]) + ")"
+// followingLine returns the rest of the line following the tokens read
+// without leading and trailing whitespace, and with comments replaced by a
+// space.
+func (tr *tokenReader) followingLine() string {
+	var sb strings.Builder
+	for i := 0; ; i++ {
+		tok, ok := tr.peek(i)
+		if !ok || tok.Type == clex.NewlineToken {
+			break
+		}
+		if tok.Type == clex.CommentToken {
+			sb.WriteByte(' ')
+		} else {
+			sb.WriteString(tok.Text)
+		}
 	}
-	return regexp.Compile(strings.Join(ns, "|"))
+	return strings.TrimSpace(sb.String())
 }
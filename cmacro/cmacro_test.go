@@ -5,43 +5,14 @@
 package cmacro
 
 import (
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
-)
 
-func TestIsMacroDefinition(t *testing.T) {
-	var cases = []struct {
-		Input string
-		IsDef bool
-	}{
-		{
-			Input: `TEST_FUNC( a, b, c )  (a, b, c)`,
-			IsDef: false,
-		},
-		{
-			Input: `#define TEST_FUNC( a, b, c )  (a, b, c)`,
-			IsDef: true,
-		},
-		{
-			Input: `  #  define   TEST_FUNC( a, b, c )  (a, b, c)`,
-			IsDef: true,
-		},
-	}
-
-	for i, tc := range cases {
-		t.Logf("Test Case: %d", i)
-
-		ni := strings.Index(tc.Input, "TEST_FUNC")
-		if ni == -1 {
-			t.Fatal("expected to find TEST_FUNC but didn't")
-		}
-
-		if isDef := isMacroDefinition(tc.Input, ni); isDef != tc.IsDef {
-			t.Errorf("expected %t but got %t", tc.IsDef, isDef)
-		}
-	}
-}
+	"github.com/jlubawy/go-ctext"
+)
 
 func TestScanInvocationsString(t *testing.T) {
 	var cases = []struct {
@@ -213,13 +184,158 @@ func TestScanInvocationsString(t *testing.T) {
 			},
 			ExpErr: false,
 		},
-
-		// Errors
 		{
-			Input:    `TEST_FUNC  );`,
-			Names:    []string{"TEST_FUNC"},
-			Expected: []Invocation{},
-			ExpErr:   true,
+			Input: `TEST_FUNC( "C:\\", a, "\\\"" );`,
+			Names: []string{"TEST_FUNC"},
+			Expected: []Invocation{
+				{
+					Name:  "TEST_FUNC",
+					Args:  []string{`"C:\\"`, "a", `"\\\""`},
+					Start: 1,
+					End:   1,
+				},
+			},
+			ExpErr: false,
+		},
+		{
+			Input: `  #  define LOG( x ) TEST_FUNC( x ); \
+								 TEST_FUNC( y )
+								 TEST_FUNC( a );`,
+			Names: []string{"TEST_FUNC"},
+			Expected: []Invocation{
+				{
+					Name:  "TEST_FUNC",
+					Args:  []string{"a"},
+					Start: 3,
+					End:   3,
+				},
+			},
+			ExpErr: false,
+		},
+		{
+			Input: `TEST_FUNC( b, c == (d, e), "f" "g" PRIu32 ) + 1;`,
+			Names: []string{"TEST_FUNC"},
+			Expected: []Invocation{
+				{
+					Name:  "TEST_FUNC",
+					Args:  []string{"b", "c == (d, e)", `"f" "g" PRIu32`},
+					Start: 1,
+					End:   1,
+				},
+			},
+			ExpErr: false,
+		},
+		{
+			Input: `callback = TEST_FUNC; TEST_FUNC  ); register(&TEST_FUNC);
+					TEST_FUNC( a );`,
+			Names: []string{"TEST_FUNC"},
+			Expected: []Invocation{
+				{
+					Name:  "TEST_FUNC",
+					Args:  []string{"a"},
+					Start: 2,
+					End:   2,
+				},
+			},
+			ExpErr: false,
+		},
+		{
+			Input: `LOG(',', x); LOG(')'); LOG(z);`,
+			Names: []string{"LOG"},
+			Expected: []Invocation{
+				{
+					Name:  "LOG",
+					Args:  []string{"','", "x"},
+					Start: 1,
+					End:   1,
+				},
+				{
+					Name:  "LOG",
+					Args:  []string{"')'"},
+					Start: 1,
+					End:   1,
+				},
+				{
+					Name:  "LOG",
+					Args:  []string{"z"},
+					Start: 1,
+					End:   1,
+				},
+			},
+			ExpErr: false,
+		},
+		{
+			Input: `LOG('"', x); LOG('\'', '\\'); LOG(y);`,
+			Names: []string{"LOG"},
+			Expected: []Invocation{
+				{
+					Name:  "LOG",
+					Args:  []string{`'"'`, "x"},
+					Start: 1,
+					End:   1,
+				},
+				{
+					Name:  "LOG",
+					Args:  []string{`'\''`, `'\\'`},
+					Start: 1,
+					End:   1,
+				},
+				{
+					Name:  "LOG",
+					Args:  []string{"y"},
+					Start: 1,
+					End:   1,
+				},
+			},
+			ExpErr: false,
+		},
+		{
+			// Invocations are found across '/' and comments, but not within
+			// string literals
+			Input: `LOG(a / b); LOG(a, /* c */ b); puts("LOG(x)"); // LOG(y)
+LOG(/* d */);`,
+			Names: []string{"LOG"},
+			Expected: []Invocation{
+				{
+					Name:  "LOG",
+					Args:  []string{"a / b"},
+					Start: 1,
+					End:   1,
+				},
+				{
+					Name:  "LOG",
+					Args:  []string{"a", "b"},
+					Start: 1,
+					End:   1,
+				},
+				{
+					Name:  "LOG",
+					Args:  []string{},
+					Start: 2,
+					End:   2,
+				},
+			},
+			ExpErr: false,
+		},
+		{
+			// A name that is a prefix of another must not hide it
+			Input: `LOG_ERROR( a ); LOG( b );`,
+			Names: []string{"LOG", "LOG_ERROR"},
+			Expected: []Invocation{
+				{
+					Name:  "LOG_ERROR",
+					Args:  []string{"a"},
+					Start: 1,
+					End:   1,
+				},
+				{
+					Name:  "LOG",
+					Args:  []string{"b"},
+					Start: 1,
+					End:   1,
+				},
+			},
+			ExpErr: false,
 		},
 	}
 
@@ -227,7 +343,7 @@ func TestScanInvocationsString(t *testing.T) {
 		t.Logf("Test Case: %d", i)
 
 		actual := make([]Invocation, 0)
-		err := ScanInvocationsString(tc.Input, func(i Invocation) { actual = append(actual, i) }, tc.Names...)
+		err := ScanInvocationsString(tc.Input, func(i Invocation) { actual = append(actual, withoutPositions(i)) }, tc.Names...)
 		if err != nil {
 			if !tc.ExpErr {
 				t.Errorf("unexpected error: %v", err)
@@ -245,3 +361,690 @@ func TestScanInvocationsString(t *testing.T) {
 		}
 	}
 }
+
+func TestScanInvocationsScanner(t *testing.T) {
+	var input = `TEST_FUNC( R"x(a "quoted", (string))x", b ); // TEST_FUNC( c );
+TEST_FUNC( u8R"(
+	multi-line
+)" );`
+
+	var expected = []Invocation{
+		{
+			Name:  "TEST_FUNC",
+			Args:  []string{`R"x(a "quoted", (string))x"`, "b"},
+			Start: 1,
+			End:   1,
+		},
+		{
+			Name:  "TEST_FUNC",
+			Args:  []string{"u8R\"(\n\tmulti-line\n)\""},
+			Start: 2,
+			End:   4,
+		},
+	}
+
+	s := ctext.NewScanner(strings.NewReader(input))
+	s.Mode = ctext.CPlusPlus
+
+	actual := make([]Invocation, 0)
+	err := ScanInvocationsScanner(s, func(i Invocation) { actual = append(actual, withoutPositions(i)) }, "TEST_FUNC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Error("data mismatch")
+		t.Errorf("%+v", expected)
+		t.Errorf("%+v", actual)
+	}
+}
+
+// withoutPositions returns the invocation with only its name, lines and
+// arguments, for tests that don't check positions.
+func withoutPositions(inv Invocation) Invocation {
+	return Invocation{
+		Name:  inv.Name,
+		Start: inv.Start,
+		End:   inv.End,
+		Args:  inv.Args,
+	}
+}
+
+// testPos returns a position within the file "test.c".
+func testPos(offset, line, column int) ctext.Position {
+	return ctext.Position{Filename: "test.c", Offset: offset, Line: line, Column: column}
+}
+
+func TestInvocationPositions(t *testing.T) {
+	var input = "x = 1; // comment\n" +
+		"TEST_FUNC( a,\n" +
+		"\t( b + c ) );\n" +
+		"TEST_FUNC(\"d\");\n"
+
+	var expected = []Invocation{
+		{
+			Name:       "TEST_FUNC",
+			Start:      2,
+			End:        3,
+			Args:       []string{"a", "( b + c )"},
+			NumArgs:    2,
+			Pos:        testPos(18, 2, 1),
+			Lparen:     testPos(27, 2, 10),
+			Rparen:     testPos(43, 3, 12),
+			Terminator: testPos(44, 3, 13),
+			EndPos:     testPos(45, 3, 14),
+			Arguments: []Argument{
+				{
+					Text:    "a",
+					Raw:     " a",
+					Trimmed: "a",
+					Pos:     testPos(29, 2, 12),
+					End:     testPos(30, 2, 13),
+					RawPos:  testPos(28, 2, 11),
+					RawEnd:  testPos(30, 2, 13),
+				},
+				{
+					Text:    "( b + c )",
+					Raw:     "\n\t( b + c ) ",
+					Trimmed: "( b + c )",
+					Pos:     testPos(33, 3, 2),
+					End:     testPos(42, 3, 11),
+					RawPos:  testPos(31, 2, 14),
+					RawEnd:  testPos(43, 3, 12),
+				},
+			},
+			Follow: ";",
+		},
+		{
+			Name:       "TEST_FUNC",
+			Start:      4,
+			End:        4,
+			Args:       []string{`"d"`},
+			NumArgs:    1,
+			Pos:        testPos(46, 4, 1),
+			Lparen:     testPos(55, 4, 10),
+			Rparen:     testPos(59, 4, 14),
+			Terminator: testPos(60, 4, 15),
+			EndPos:     testPos(61, 4, 16),
+			Arguments: []Argument{
+				{
+					Text:    `"d"`,
+					Raw:     `"d"`,
+					Trimmed: `"d"`,
+					Pos:     testPos(56, 4, 11),
+					End:     testPos(59, 4, 14),
+					RawPos:  testPos(56, 4, 11),
+					RawEnd:  testPos(59, 4, 14),
+				},
+			},
+			Follow: ";",
+		},
+	}
+
+	s := ctext.NewScanner(strings.NewReader(input))
+	s.Filename = "test.c"
+
+	actual := make([]Invocation, 0)
+	err := ScanInvocationsScanner(s, func(i Invocation) { actual = append(actual, i) }, "TEST_FUNC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Error("data mismatch")
+		t.Errorf("%#v", expected)
+		t.Errorf("%#v", actual)
+	}
+}
+
+func TestScanInvocationsFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.c")
+	if err := os.WriteFile(filename, []byte("int a;\n  TEST_FUNC( b );\n"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	var actual []ctext.Position
+	err := ScanInvocationsFile(filename, func(i Invocation) { actual = append(actual, i.Pos, i.Lparen, i.Terminator) }, "TEST_FUNC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ctext.Position{
+		{Filename: filename, Offset: 9, Line: 2, Column: 3},
+		{Filename: filename, Offset: 18, Line: 2, Column: 12},
+		{Filename: filename, Offset: 23, Line: 2, Column: 17},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %v but got %v", expected, actual)
+	}
+}
+
+func TestArgumentRewrite(t *testing.T) {
+	var (
+		input    = "TEST_FUNC( \"a\",\n           b +\n           c );\n"
+		expected = "TEST_FUNC( \"a\",\n           x );\n"
+	)
+
+	var args []Argument
+	err := ScanInvocationsString(input, func(i Invocation) { args = i.Arguments }, "TEST_FUNC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 2 {
+		t.Fatalf("expected 2 arguments but got %d", len(args))
+	}
+
+	arg := args[1]
+	if arg.Trimmed != "b +\n           c" || arg.Text != "b +           c" {
+		t.Errorf("unexpected argument %+v", arg)
+	}
+	if input[arg.RawPos.Offset:arg.RawEnd.Offset] != arg.Raw {
+		t.Errorf("raw argument %q doesn't match the source", arg.Raw)
+	}
+	if input[arg.Pos.Offset:arg.End.Offset] != arg.Trimmed {
+		t.Errorf("trimmed argument %q doesn't match the source", arg.Trimmed)
+	}
+
+	actual := input[:arg.Pos.Offset] + "x" + input[arg.End.Offset:]
+	if actual != expected {
+		t.Errorf("expected %q but got %q", expected, actual)
+	}
+}
+
+func TestEmptyArguments(t *testing.T) {
+	var input = "F(a, ,b); F();"
+
+	var invs []Invocation
+	err := ScanInvocationsString(input, func(i Invocation) { invs = append(invs, i) }, "F")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invs) != 2 {
+		t.Fatalf("expected 2 invocations but got %d", len(invs))
+	}
+
+	inv := invs[0]
+	if !reflect.DeepEqual(inv.Args, []string{"a", "b"}) || inv.NumArgs != 3 || len(inv.Arguments) != 3 {
+		t.Fatalf("unexpected arguments %q, %+v", inv.Args, inv.Arguments)
+	}
+	expected := Argument{
+		Raw:    " ",
+		Pos:    ctext.Position{Offset: 4, Line: 1, Column: 5},
+		End:    ctext.Position{Offset: 4, Line: 1, Column: 5},
+		RawPos: ctext.Position{Offset: 4, Line: 1, Column: 5},
+		RawEnd: ctext.Position{Offset: 5, Line: 1, Column: 6},
+	}
+	if !reflect.DeepEqual(expected, inv.Arguments[1]) {
+		t.Errorf("expected %+v but got %+v", expected, inv.Arguments[1])
+	}
+	if arg := inv.Arguments[2]; arg.Text != "b" || input[arg.Pos.Offset:arg.End.Offset] != "b" {
+		t.Errorf("unexpected argument %+v", arg)
+	}
+
+	if inv := invs[1]; inv.NumArgs != 0 || len(inv.Arguments) != 0 {
+		t.Errorf("expected no arguments but got %+v", inv.Arguments)
+	}
+}
+
+func TestScanIdentifiers(t *testing.T) {
+	var input = `#define LOG LOG_ERROR
+void f(void) {
+	LOG_ERROR ( "a" );
+	register_handler(LOG_ERROR, &LOG_ERROR);
+	x = y & LOG_ERROR; /* LOG_ERROR */ p = "LOG_ERROR";
+	z = (flags)&LOG_ERROR;
+}
+`
+
+	var expected = []Identifier{
+		{"LOG_ERROR", Call, ctext.Position{Offset: 38, Line: 3, Column: 2}, ctext.Position{Offset: 47, Line: 3, Column: 11}},
+		{"LOG_ERROR", Use, ctext.Position{Offset: 75, Line: 4, Column: 19}, ctext.Position{Offset: 84, Line: 4, Column: 28}},
+		{"LOG_ERROR", AddressOf, ctext.Position{Offset: 87, Line: 4, Column: 31}, ctext.Position{Offset: 96, Line: 4, Column: 40}},
+		{"LOG_ERROR", Use, ctext.Position{Offset: 108, Line: 5, Column: 10}, ctext.Position{Offset: 117, Line: 5, Column: 19}},
+		{"LOG_ERROR", Use, ctext.Position{Offset: 165, Line: 6, Column: 14}, ctext.Position{Offset: 174, Line: 6, Column: 23}},
+	}
+
+	var actual []Identifier
+	err := ScanIdentifiersString(input, func(id Identifier) { actual = append(actual, id) }, "LOG_ERROR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Error("data mismatch")
+		t.Errorf("%+v", expected)
+		t.Errorf("%+v", actual)
+	}
+}
+
+func TestScanIdentifiersKeywords(t *testing.T) {
+	var input = `return &X; n = sizeof &X;
+switch (p) { case &X: break; }
+if (a) p = 0; else &X;
+y = ret & X;`
+
+	var expected = []Kind{AddressOf, AddressOf, AddressOf, AddressOf, Use}
+
+	var actual []Kind
+	err := ScanIdentifiersString(input, func(id Identifier) { actual = append(actual, id.Kind) }, "X")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %v but got %v", expected, actual)
+	}
+}
+
+func TestInvocationsWithoutSemicolon(t *testing.T) {
+	var input = `if (CHECK(x) && CHECK( y )) {
+	int a[] = { ENTRY(1), ENTRY(2) };
+	FOREACH(x) {
+	}
+}`
+
+	type result struct {
+		Name       string
+		Args       []string
+		End        int
+		Follow     string
+		Terminated bool
+	}
+	var expected = []result{
+		{"CHECK", []string{"x"}, 1, "&& CHECK( y )) {", false},
+		{"CHECK", []string{"y"}, 1, ") {", false},
+		{"ENTRY", []string{"1"}, 2, ", ENTRY(2) };", false},
+		{"ENTRY", []string{"2"}, 2, "};", false},
+		{"FOREACH", []string{"x"}, 3, "{", false},
+	}
+
+	var actual []result
+	err := ScanInvocationsString(input, func(i Invocation) {
+		actual = append(actual, result{i.Name, i.Args, i.End, i.Follow, i.Terminator.IsValid()})
+	}, "CHECK", "ENTRY", "FOREACH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Error("data mismatch")
+		t.Errorf("%+v", expected)
+		t.Errorf("%+v", actual)
+	}
+}
+
+func TestScanDefinitions(t *testing.T) {
+	var input = `#include <stdio.h>
+#define VERSION 3 /* major */
+  #  define MAX( a, b ) \
+	((a) > (b) ? (a) : (b))
+#define LOG(fmt, ...) printf(fmt, __VA_ARGS__)
+#define TRACE(args...) trace(args)
+#define EMPTY()
+#define NOTFUNC (x)
+#undef VERSION
+int x; // #define NOT_A_DEFINITION
+`
+
+	var expected = []Definition{
+		{
+			Name:    "VERSION",
+			Body:    "3",
+			Pos:     ctext.Position{Offset: 19, Line: 2, Column: 1},
+			NamePos: ctext.Position{Offset: 27, Line: 2, Column: 9},
+			End:     ctext.Position{Offset: 48, Line: 2, Column: 30},
+		},
+		{
+			Name:         "MAX",
+			FunctionLike: true,
+			Params:       []string{"a", "b"},
+			Body:         "((a) > (b) ? (a) : (b))",
+			Pos:          ctext.Position{Offset: 51, Line: 3, Column: 3},
+			NamePos:      ctext.Position{Offset: 61, Line: 3, Column: 13},
+			End:          ctext.Position{Offset: 99, Line: 4, Column: 25},
+		},
+		{
+			Name:         "LOG",
+			FunctionLike: true,
+			Params:       []string{"fmt", "__VA_ARGS__"},
+			Variadic:     true,
+			Body:         "printf(fmt, __VA_ARGS__)",
+			Pos:          ctext.Position{Offset: 100, Line: 5, Column: 1},
+			NamePos:      ctext.Position{Offset: 108, Line: 5, Column: 9},
+			End:          ctext.Position{Offset: 146, Line: 5, Column: 47},
+		},
+		{
+			Name:         "TRACE",
+			FunctionLike: true,
+			Params:       []string{"args"},
+			Variadic:     true,
+			Body:         "trace(args)",
+			Pos:          ctext.Position{Offset: 147, Line: 6, Column: 1},
+			NamePos:      ctext.Position{Offset: 155, Line: 6, Column: 9},
+			End:          ctext.Position{Offset: 181, Line: 6, Column: 35},
+		},
+		{
+			Name:         "EMPTY",
+			FunctionLike: true,
+			Params:       []string{},
+			Pos:          ctext.Position{Offset: 182, Line: 7, Column: 1},
+			NamePos:      ctext.Position{Offset: 190, Line: 7, Column: 9},
+			End:          ctext.Position{Offset: 197, Line: 7, Column: 16},
+		},
+		{
+			Name:    "NOTFUNC",
+			Body:    "(x)",
+			Pos:     ctext.Position{Offset: 198, Line: 8, Column: 1},
+			NamePos: ctext.Position{Offset: 206, Line: 8, Column: 9},
+			End:     ctext.Position{Offset: 217, Line: 8, Column: 20},
+		},
+		{
+			Name:    "VERSION",
+			Undef:   true,
+			Pos:     ctext.Position{Offset: 218, Line: 9, Column: 1},
+			NamePos: ctext.Position{Offset: 225, Line: 9, Column: 8},
+			End:     ctext.Position{Offset: 232, Line: 9, Column: 15},
+		},
+	}
+
+	var actual []Definition
+	err := ScanDefinitionsString(input, func(def Definition) { actual = append(actual, def) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expected) != len(actual) {
+		t.Fatalf("expected %d definitions but got %d: %+v", len(expected), len(actual), actual)
+	}
+	for i := range expected {
+		if !reflect.DeepEqual(expected[i], actual[i]) {
+			t.Errorf("expected %#v", expected[i])
+			t.Errorf("but got  %#v", actual[i])
+		}
+	}
+
+	var strs []string
+	for _, def := range actual {
+		strs = append(strs, def.String())
+	}
+	expStrs := []string{
+		"#define VERSION 3",
+		"#define MAX(a, b) ((a) > (b) ? (a) : (b))",
+		"#define LOG(fmt, ...) printf(fmt, __VA_ARGS__)",
+		"#define TRACE(args...) trace(args)",
+		"#define EMPTY()",
+		"#define NOTFUNC (x)",
+		"#undef VERSION",
+	}
+	if !reflect.DeepEqual(expStrs, strs) {
+		t.Errorf("expected %q but got %q", expStrs, strs)
+	}
+}
+
+func TestScanDefinitionsErrors(t *testing.T) {
+	var cases = []string{
+		"#define\n",
+		"#define 1 2\n",
+		"#define F(a b) a\n",
+		"#define F(a,) a\n",
+		"#define F(..., a) a\n",
+		"#define F(a\n",
+	}
+
+	for _, input := range cases {
+		err := ScanDefinitionsString(input, func(Definition) {})
+		if err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
+
+func TestExpandString(t *testing.T) {
+	var cases = []struct {
+		Input    string
+		Expected string
+	}{
+		{
+			Input:    "#define LOG(fmt, ...) printf(fmt, __VA_ARGS__)\nLOG(\"%d %d\\n\", a, b);\n",
+			Expected: "\nprintf(\"%d %d\\n\", a, b);\n",
+		},
+		{
+			Input:    "#define X 1 + X\nint a = X;",
+			Expected: "\nint a = 1 + X;",
+		},
+		{
+			// C11 6.10.3.5 example 3
+			Input: `#define x 3
+#define f(a) f(x * (a))
+#undef x
+#define x 2
+#define g f
+#define z z[0]
+#define h g(~
+#define m(a) a(w)
+#define w 0,1
+#define t(a) a
+#define p() int
+#define q(x) x
+#define r(x,y) x ## y
+#define str(x) # x
+f(y+1) + f(f(z)) % t(t(g)(0) + t)(1);
+g(x+(3,4)-w) | h 5) & m
+(f)^m(m);
+p() i[q()] = { q(1), r(2,3), r(4,), r(,5), r(,) };
+char c[2][6] = { str(hello), str() };`,
+			Expected: "\n\n\n\n\n\n\n\n\n\n\n\n\n\n" +
+				`f(2 * (y+1)) + f(2 * (f(2 * (z[0])))) % f(2 * (0)) + t(1);
+f(2 * (2+(3,4)-0,1)) | f(2 * (~ 5)) & f(2 * (0,1))^m(0,1);
+int i[] = { 1, 23, 4, 5, };
+char c[2][6] = { "hello", "" };`,
+		},
+		{
+			// C11 6.10.3.5 example 4
+			Input: `#define str(s) # s
+#define xstr(s) str(s)
+#define debug(s, t) printf("x" # s "= %d, x" # t "= %s", \
+ x ## s, x ## t)
+#define INCFILE(n) vers ## n
+#define glue(a, b) a ## b
+#define xglue(a, b) glue(a, b)
+#define HIGHLOW "hello"
+#define LOW LOW ", world"
+debug(1, 2);
+fputs(str(strncmp("abc\0d", "abc", '\4') // this goes away
+ == 0) str(: @\n), s);
+xstr(INCFILE(2).h)
+glue(HIGH, LOW);
+xglue(HIGH, LOW)`,
+			Expected: "\n\n\n\n\n\n\n\n" +
+				`printf("x" "1" "= %d, x" "2" "= %s", x1, x2);
+fputs("strncmp(\"abc\\0d\", \"abc\", '\\4') == 0" ": @\n", s);
+"vers2.h"
+"hello";
+"hello" ", world"`,
+		},
+		{
+			// C11 6.10.3.5 example 5
+			Input: `#define hash_hash # ## #
+#define mkstr(a) # a
+#define in_between(a) mkstr(a)
+#define join(c, d) in_between(c hash_hash d)
+char p[] = join(x, y);`,
+			Expected: "\n\n\n\n" + `char p[] = "x ## y";`,
+		},
+		{
+			// C11 6.10.3.5 example 7
+			Input: `#define debug(...) fprintf(stderr, __VA_ARGS__)
+#define showlist(...) puts(#__VA_ARGS__)
+#define report(test, ...) ((test)?puts(#test):\
+ printf(__VA_ARGS__))
+debug("Flag");
+debug("X = %d\n", x);
+showlist(The first, second, and third items.);
+report(x>y, "x is %d but y is %d", x, y);`,
+			Expected: "\n\n\n" +
+				`fprintf(stderr, "Flag");
+fprintf(stderr, "X = %d\n", x);
+puts("The first, second, and third items.");
+((x>y)?puts("x>y"): printf("x is %d but y is %d", x, y));`,
+		},
+		{
+			// __VA_OPT__
+			Input: `#define F(a, ...) f(a __VA_OPT__(,) __VA_ARGS__)
+#define G(X, ...) X __VA_OPT__(- X ## __VA_ARGS__) end
+F(1) F(1, 2, 3) G(a) G(a, b)`,
+			Expected: "\n\n" + `f(1 ) f(1 , 2, 3) a end a - ab end`,
+		},
+		{
+			// GNU comma elision
+			Input: `#define LOG(fmt, ...) printf(fmt, ##__VA_ARGS__)
+#define TRACE(fmt, args...) trace(fmt , ## args)
+LOG("a"); LOG("%d", 1); TRACE("b"); TRACE("%d %d", 1, 2);`,
+			Expected: "\n\n" + `printf("a"); printf("%d", 1); trace("b"); trace("%d %d" , 1, 2);`,
+		},
+		{
+			// Function-like macros without arguments aren't invoked
+			Input:    "#define F(x) [x]\nint (*p)(int) = F; F\n(1)",
+			Expected: "\nint (*p)(int) = F; [1]",
+		},
+		{
+			// Macros that expand to nothing keep the whitespace before them
+			Input:    "#define LOG(...)\n#define E\nint a;\nLOG(\"x\");\nint b;\nE int c;\nLOG(1)\nE",
+			Expected: "\n\nint a;\n;\nint b;\n int c;\n\n",
+		},
+		{
+			// Tokens that would otherwise be joined are separated
+			Input:    "#define NEG -1\nint a = -NEG;",
+			Expected: "\nint a = - -1;",
+		},
+		{
+			// Other directives are kept
+			Input:    "#include <stdio.h>\n#define A 1\n#if A\nA\n#endif\n",
+			Expected: "#include <stdio.h>\n\n#if A\n1\n#endif\n",
+		},
+	}
+
+	for i, tc := range cases {
+		t.Logf("Test Case: %d", i)
+
+		actual, err := NewExpander().ExpandString(tc.Input)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if actual != tc.Expected {
+			t.Errorf("expected:\n%s\nbut got:\n%s", tc.Expected, actual)
+		}
+	}
+}
+
+func TestExpandErrors(t *testing.T) {
+	var cases = []string{
+		"#define F(a, b) a\nF(1)",
+		"#define F(a, b, ...) a\nF()",
+		"#define F(a) a\nF(1",
+		"#define F(a) #b\n",
+		"#define F(a) ## a\n",
+		"#define F __VA_ARGS__\n",
+		"#define F(a, b) a ## b\nF(+, -)",
+	}
+
+	for _, input := range cases {
+		if _, err := NewExpander().ExpandString(input); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	const defs = `#define MAX(a, b) ((a) > (b) ? (a) : (b))
+#define LOG(fmt, ...) printf(fmt, __VA_ARGS__)
+#define ONE(x) x
+#define NONE() 0
+#define VERSION 3
+`
+	const input = `MAX(1, 2);
+MAX(1);
+LOG("hi");
+LOG("%d %d", a, b);
+LOG();
+ONE();
+ONE(1, 2);
+TRACE(1);
+MAX(1,,2);
+MAX(,);
+ONE(,);
+NONE();
+NONE(1);
+`
+
+	v := NewValidator()
+	err := ScanDefinitionsString(defs, v.Define)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = v.ReadArities(strings.NewReader("# tracing\nTRACE 2+\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expNames := []string{"LOG", "MAX", "NONE", "ONE", "TRACE"}
+	if names := v.Names(); !reflect.DeepEqual(expNames, names) {
+		t.Errorf("expected names %q but got %q", expNames, names)
+	}
+
+	var actual []string
+	err = v.ValidateString(input, func(err *ArityError) { actual = append(actual, err.Error()) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`<input>:2:1: macro "MAX" requires 2 arguments, but 1 given`,
+		`<input>:7:1: macro "ONE" requires 1 arguments, but 2 given`,
+		`<input>:8:1: macro "TRACE" requires at least 2 arguments, but only 1 given`,
+		`<input>:9:1: macro "MAX" requires 2 arguments, but 3 given`,
+		`<input>:11:1: macro "ONE" requires 1 arguments, but 2 given`,
+		`<input>:13:1: macro "NONE" requires 0 arguments, but 1 given`,
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %q but got %q", expected, actual)
+	}
+}
+
+func TestValidateDefinitionOrder(t *testing.T) {
+	const input = `F(1);
+#define ENTRY(a, b) {a, b},
+#define F(a, b) a
+int x[][2] = {
+	ENTRY(1, 2)
+	ENTRY(1)
+};
+#undef ENTRY
+ENTRY(1);
+F(1);
+`
+
+	var actual []string
+	err := NewValidator().ValidateString(input, func(err *ArityError) { actual = append(actual, err.Error()) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`<input>:6:2: macro "ENTRY" requires 2 arguments, but 1 given`,
+		`<input>:10:1: macro "F" requires 2 arguments, but 1 given`,
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %q but got %q", expected, actual)
+	}
+}
+
+func TestParseArity(t *testing.T) {
+	for _, s := range []string{"0", "2", "1+"} {
+		a, err := ParseArity(s)
+		if err != nil {
+			t.Error(err)
+		} else if a.String() != s {
+			t.Errorf("expected %q but got %q", s, a)
+		}
+	}
+
+	for _, s := range []string{"", "+", "-1", "x", "1++"} {
+		if _, err := ParseArity(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmacro
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jlubawy/go-ctext"
+	"github.com/jlubawy/go-ctext/clex"
+)
+
+// A Definition is a #define or #undef directive within C source code.
+type Definition struct {
+	Name         string   // name of the macro
+	Undef        bool     // true for #undef, otherwise #define
+	FunctionLike bool     // true if the macro has a parameter list, even if empty
+	Params       []string // names of the parameters, including the variable arguments (see Variadic)
+	Variadic     bool     // true if the last parameter is the variable arguments, named __VA_ARGS__ for "..." or as given (e.g. "args...")
+	Body         string   // replacement list with line continuations joined and comments replaced by a space
+
+	Pos     ctext.Position // position of the '#' of the directive
+	NamePos ctext.Position // position of the name of the macro
+	End     ctext.Position // position immediately following the directive, not including the newline
+}
+
+func (def Definition) String() string {
+	if def.Undef {
+		return "#undef " + def.Name
+	}
+
+	s := "#define " + def.Name
+	if def.FunctionLike {
+		params := def.Params
+		if n := len(params); def.Variadic && n > 0 {
+			params = append([]string(nil), params...)
+			if params[n-1] == "__VA_ARGS__" {
+				params[n-1] = "..."
+			} else {
+				params[n-1] += "..."
+			}
+		}
+		s += "(" + strings.Join(params, ", ") + ")"
+	}
+	if def.Body != "" {
+		s += " " + def.Body
+	}
+	return s
+}
+
+// ScanDefinitions scans the provided io.Reader for macro definitions,
+// returning each #define and #undef directive via the provided callback.
+func ScanDefinitions(r io.Reader, scanFunc func(def Definition)) (err error) {
+	return ScanDefinitionsScanner(clex.NewScanner(r), scanFunc)
+}
+
+// ScanDefinitionsString scans the provided string for macro definitions,
+// returning each #define and #undef directive via the provided callback.
+func ScanDefinitionsString(s string, scanFunc func(def Definition)) (err error) {
+	return ScanDefinitions(strings.NewReader(s), scanFunc)
+}
+
+// ScanDefinitionsScanner is like ScanDefinitions but reads from the provided
+// scanner, so that its Mode and Filename may be set.
+func ScanDefinitionsScanner(s *clex.Scanner, scanFunc func(def Definition)) (err error) {
+	const (
+		lineStart = iota // only whitespace or comments so far on the line
+		afterHash        // after a '#' at the start of the line
+		inDef            // within a #define or #undef directive
+		skipLine         // skipping the rest of the line
+	)
+
+	var (
+		line  []clex.Token // tokens of the current directive
+		state = lineStart
+	)
+	for {
+		tt := s.Next()
+		if tt == clex.ErrorToken || tt == clex.NewlineToken {
+			if state == inDef {
+				var def Definition
+				def, err = parseDefinition(line)
+				if err != nil {
+					return
+				}
+				scanFunc(def)
+			}
+			if tt == clex.ErrorToken {
+				err = s.Err()
+				if err == io.EOF {
+					err = nil
+				}
+				return
+			}
+			line, state = line[:0], lineStart
+			continue
+		}
+
+		tok := s.Token()
+		significant := tt != clex.WhitespaceToken && tt != clex.CommentToken
+		switch {
+		case state == inDef:
+			line = append(line, tok)
+
+		case !significant:
+			if state == afterHash {
+				line = append(line, tok)
+			}
+
+		case state == lineStart:
+			state = skipLine
+			if tt == clex.PunctuatorToken && (tok.Spelling() == "#" || tok.Spelling() == "%:") {
+				line = append(line, tok)
+				state = afterHash
+			}
+
+		case state == afterHash:
+			line = append(line, tok)
+			state = skipLine
+			if tt == clex.IdentifierToken && (tok.Spelling() == "define" || tok.Spelling() == "undef") {
+				state = inDef
+			}
+		}
+	}
+}
+
+// significant returns the tokens that aren't whitespace or comments.
+func significant(toks []clex.Token) (sig []clex.Token) {
+	for _, tok := range toks {
+		if tok.Type != clex.WhitespaceToken && tok.Type != clex.CommentToken {
+			sig = append(sig, tok)
+		}
+	}
+	return
+}
+
+// parseDefinition parses the tokens of a #define or #undef directive,
+// starting with the '#'.
+func parseDefinition(line []clex.Token) (def Definition, err error) {
+	sig := significant(line)
+	def.Pos = sig[0].Position
+	def.End = line[len(line)-1].End
+	def.Undef = sig[1].Spelling() == "undef"
+	if len(sig) < 3 || sig[2].Type != clex.IdentifierToken {
+		err = fmt.Errorf("%s: macro name missing in #%s", sig[1].Position, sig[1].Spelling())
+		return
+	}
+	def.Name = sig[2].Spelling()
+	def.NamePos = sig[2].Position
+	if def.Undef {
+		return
+	}
+
+	// Find the tokens following the name
+	var i int
+	for i = 0; line[i].Position != def.NamePos; i++ {
+	}
+	rest := line[i+1:]
+
+	// A function-like macro has a parenthesis immediately following the name
+	if len(rest) > 0 && rest[0].Type == clex.PunctuatorToken && rest[0].Spelling() == "(" {
+		def.FunctionLike = true
+		def.Params = make([]string, 0)
+
+		var (
+			toks        = significant(rest[1:])
+			j           int
+			expectParam = true // a parameter is expected, i.e. after '(' or ','
+		)
+		for ; j < len(toks); j++ {
+			tok := toks[j]
+			sp := tok.Spelling()
+			if sp == ")" && (!expectParam || j == 0) {
+				break
+			}
+
+			switch {
+			case def.Variadic:
+				err = fmt.Errorf("%s: expected ')' after \"...\" in parameter list of %s", tok.Position, def.Name)
+				return
+			case expectParam && tok.Type == clex.IdentifierToken:
+				def.Params = append(def.Params, sp)
+				expectParam = false
+			case sp == "...":
+				// Either "..." or a named variadic parameter (e.g. "args...")
+				if expectParam {
+					def.Params = append(def.Params, "__VA_ARGS__")
+				}
+				def.Variadic = true
+				expectParam = false
+			case !expectParam && sp == ",":
+				expectParam = true
+			default:
+				err = fmt.Errorf("%s: unexpected %q in parameter list of %s", tok.Position, tok.Text, def.Name)
+				return
+			}
+		}
+		if j == len(toks) {
+			err = fmt.Errorf("%s: missing ')' in parameter list of %s", def.NamePos, def.Name)
+			return
+		}
+
+		// Find the tokens following the parameter list
+		for i = 1; rest[i].Position != toks[j].Position; i++ {
+		}
+		rest = rest[i+1:]
+	}
+
+	def.Body = joinTokens(rest)
+	return
+}
+
+// joinTokens returns the spelling of the tokens with any whitespace or comments
+// between them replaced by a single space, without leading and trailing
+// whitespace.
+func joinTokens(toks []clex.Token) string {
+	var (
+		sb    strings.Builder
+		space bool
+	)
+	for _, tok := range toks {
+		if tok.Type == clex.WhitespaceToken || tok.Type == clex.CommentToken {
+			space = true
+			continue
+		}
+		if space && sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		space = false
+		sb.WriteString(tok.Spelling())
+	}
+	return sb.String()
+}
@@ -0,0 +1,683 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmacro
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jlubawy/go-ctext"
+	"github.com/jlubawy/go-ctext/clex"
+)
+
+// An Expander expands macro invocations as described by the C11 standard
+// (6.10.3), using the definitions it has been given. This includes argument
+// substitution, the # and ## operators, variable arguments (including the C23
+// __VA_OPT__ and the GNU ", ## __VA_ARGS__" comma elision), and rescanning,
+// where a macro is never expanded within its own expansion.
+//
+// Conditional inclusion (e.g. #if) and #include directives aren't processed,
+// and there are no predefined macros.
+type Expander struct {
+	macros map[string]*macro
+}
+
+// NewExpander returns a pointer to a new expander without any definitions.
+func NewExpander() *Expander {
+	return &Expander{
+		macros: make(map[string]*macro),
+	}
+}
+
+// A macro is a definition with its replacement list split into tokens.
+type macro struct {
+	Definition
+	body []ppToken
+}
+
+// A ppToken is a preprocessing token being expanded.
+type ppToken struct {
+	clex.Token
+	ws          string          // whitespace preceding the token
+	hide        map[string]bool // names of the macros that must not be expanded (i.e. painted blue)
+	paste       bool            // a ## operator from a replacement list
+	expanded    bool            // part of the expansion of a macro
+	placemarker bool            // an empty argument, removed after pasting
+}
+
+// Define adds the definition, or removes it for an #undef. An error is
+// returned if the replacement list isn't valid.
+func (e *Expander) Define(def Definition) (err error) {
+	if def.Undef {
+		delete(e.macros, def.Name)
+		return
+	}
+
+	m := &macro{Definition: def}
+	m.body, err = lexTokens(def.Body)
+	if err != nil {
+		return
+	}
+	for i, t := range m.body {
+		m.body[i].Position = def.NamePos
+
+		switch {
+		case t.Text == "##" || t.Text == "%:%:":
+			if i == 0 || i == len(m.body)-1 {
+				err = fmt.Errorf("%s: '##' cannot appear at either end of a macro expansion", def.NamePos)
+				return
+			}
+			m.body[i].paste = true
+
+		case def.FunctionLike && (t.Text == "#" || t.Text == "%:"):
+			if i == len(m.body)-1 || m.param(m.body[i+1]) == -1 {
+				err = fmt.Errorf("%s: '#' is not followed by a macro parameter", def.NamePos)
+				return
+			}
+
+		case t.Text == "__VA_ARGS__" && (!def.Variadic || def.Params[len(def.Params)-1] != t.Text):
+			err = fmt.Errorf("%s: __VA_ARGS__ can only appear in the expansion of a variadic macro", def.NamePos)
+			return
+
+		case t.Text == "__VA_OPT__" && !def.Variadic:
+			err = fmt.Errorf("%s: __VA_OPT__ can only appear in the expansion of a variadic macro", def.NamePos)
+			return
+		}
+	}
+
+	e.macros[def.Name] = m
+	return
+}
+
+// Defined returns true if the named macro is defined.
+func (e *Expander) Defined(name string) bool {
+	_, ok := e.macros[name]
+	return ok
+}
+
+// ExpandString expands the macros in the provided source, returning the
+// result. See Expand.
+func (e *Expander) ExpandString(s string) (string, error) {
+	var sb strings.Builder
+	err := e.Expand(&sb, clex.NewScanner(strings.NewReader(s)))
+	return sb.String(), err
+}
+
+// Expand expands the macros in the source read from the scanner, writing the
+// result to w. Any #define and #undef directives are added to the expander,
+// and are replaced by empty lines. Other directives are written unchanged,
+// and comments are replaced by a space.
+func (e *Expander) Expand(w io.Writer, s *clex.Scanner) (err error) {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	var (
+		toks      []ppToken    // tokens waiting to be expanded
+		ws        string       // whitespace preceding the next token
+		lead      []clex.Token // whitespace and comments at the start of the line
+		directive []clex.Token // tokens of a directive
+		lineStart = true
+	)
+
+	// flush expands and writes the waiting tokens
+	flush := func() (err error) {
+		toks, err = e.expand(toks)
+		if err != nil {
+			return
+		}
+		err = writeTokens(bw, toks)
+		if err != nil {
+			return
+		}
+		_, err = bw.WriteString(ws)
+		toks, ws = toks[:0], ""
+		return
+	}
+
+	for {
+		tt := s.Next()
+		if tt == clex.ErrorToken || tt == clex.NewlineToken {
+			if directive != nil {
+				err = e.directive(bw, directive)
+				if err != nil {
+					return
+				}
+			} else {
+				ws += joinSpace(lead)
+			}
+			if tt == clex.ErrorToken {
+				err = s.Err()
+				if err == io.EOF {
+					err = flush()
+				}
+				return
+			}
+			ws += s.TokenText()
+			lead, directive, lineStart = lead[:0], nil, true
+			continue
+		}
+
+		tok := s.Token()
+		switch {
+		case directive != nil:
+			directive = append(directive, tok)
+
+		case tt == clex.WhitespaceToken || tt == clex.CommentToken:
+			if lineStart {
+				lead = append(lead, tok)
+			} else {
+				ws += joinSpace([]clex.Token{tok})
+			}
+
+		case lineStart && tt == clex.PunctuatorToken && (tok.Text == "#" || tok.Text == "%:"):
+			// Expand everything before the directive
+			err = flush()
+			if err != nil {
+				return
+			}
+			directive = append(append([]clex.Token{}, lead...), tok)
+			lineStart = false
+
+		default:
+			if lineStart {
+				ws += joinSpace(lead)
+				lead, lineStart = lead[:0], false
+			}
+			tok.Text = tok.Spelling()
+			toks = append(toks, ppToken{Token: tok, ws: ws})
+			ws = ""
+		}
+	}
+}
+
+// directive processes a directive, writing an empty line in its place if it
+// is a definition, otherwise the directive unchanged.
+func (e *Expander) directive(bw *bufio.Writer, line []clex.Token) (err error) {
+	sig := significant(line)
+	if len(sig) > 1 && sig[1].Type == clex.IdentifierToken && (sig[1].Spelling() == "define" || sig[1].Spelling() == "undef") {
+		var def Definition
+		def, err = parseDefinition(line)
+		if err != nil {
+			return
+		}
+		return e.Define(def)
+	}
+
+	for _, tok := range line {
+		_, err = bw.WriteString(tok.Text)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// expand fully expands the macros in the tokens, using the algorithm by Dave
+// Prosser where each token has a set of the macros whose expansion it is part
+// of, which it must not be expanded by.
+func (e *Expander) expand(toks []ppToken) (out []ppToken, err error) {
+	var in tokenStack
+	in.push(toks)
+
+	out = make([]ppToken, 0, len(toks))
+	for len(in) > 0 {
+		t := in.peek(0)
+		m, ok := e.macros[t.Text]
+		if t.Type != clex.IdentifierToken || !ok || t.hide[t.Text] {
+			out = append(out, t)
+			in.pop(1)
+			continue
+		}
+
+		if !m.FunctionLike {
+			var repl []ppToken
+			repl, err = e.subst(m, m.body, nil, t)
+			if err != nil {
+				return
+			}
+			in.pop(1)
+			out = in.pushExpansion(out, withHidden(repl, t.hide, t.Text), t.ws)
+			continue
+		}
+
+		// A function-like macro is only invoked if followed by a parenthesis
+		if len(in) < 2 || in.peek(1).Text != "(" {
+			out = append(out, t)
+			in.pop(1)
+			continue
+		}
+
+		var (
+			args   [][]ppToken
+			rparen ppToken
+			n      int
+		)
+		args, rparen, n, err = collectArgs(m, in, t)
+		if err != nil {
+			return
+		}
+
+		var repl []ppToken
+		repl, err = e.subst(m, m.body, args, t)
+		if err != nil {
+			return
+		}
+		in.pop(n)
+		out = in.pushExpansion(out, withHidden(repl, intersect(t.hide, rparen.hide), t.Text), t.ws)
+	}
+	return
+}
+
+// A tokenStack is a stack of tokens to be expanded, with the next token at the
+// end so that the tokens of an expansion can be pushed in front of the rest.
+type tokenStack []ppToken
+
+// peek returns the ith next token.
+func (ts tokenStack) peek(i int) ppToken {
+	return ts[len(ts)-1-i]
+}
+
+// pop removes the next n tokens.
+func (ts *tokenStack) pop(n int) {
+	*ts = (*ts)[:len(*ts)-n]
+}
+
+// push adds the tokens in front of the rest.
+func (ts *tokenStack) push(toks []ppToken) {
+	for i := len(toks) - 1; i >= 0; i-- {
+		*ts = append(*ts, toks[i])
+	}
+}
+
+// pushExpansion adds the expansion of a macro in front of the rest. If the
+// expansion is empty then the whitespace that preceded the macro (e.g. a
+// newline) is added to that of the next token, or else to the output as a
+// placemarker, so that lines aren't joined.
+func (ts *tokenStack) pushExpansion(out []ppToken, repl []ppToken, ws string) []ppToken {
+	if len(repl) > 0 {
+		ts.push(repl)
+	} else if n := len(*ts); n > 0 {
+		if next := &(*ts)[n-1]; next.ws == "" || strings.Contains(ws, "\n") {
+			next.ws = ws + next.ws
+		}
+	} else if ws != "" {
+		out = append(out, ppToken{ws: ws, placemarker: true})
+	}
+	return out
+}
+
+// collectArgs returns the arguments of an invocation of the macro whose name
+// is the next token, the closing parenthesis, and the number of tokens of the
+// invocation.
+func collectArgs(m *macro, in tokenStack, name ppToken) (args [][]ppToken, rparen ppToken, n int, err error) {
+	var (
+		depth int
+		arg   = make([]ppToken, 0)
+	)
+	for n = 2; n < len(in); n++ {
+		t := in.peek(n)
+		if strings.Contains(t.ws, "\n") {
+			t.ws = " "
+		}
+
+		switch {
+		case t.Text == "(":
+			depth += 1
+		case t.Text == ")" && depth > 0:
+			depth -= 1
+		case t.Text == ")":
+			args = append(args, arg)
+			rparen = t
+			n += 1
+			err = checkArgs(m, &args, name)
+			return
+		case t.Text == "," && depth == 0 && !(m.Variadic && len(args) == len(m.Params)-1):
+			// The variable arguments include any commas
+			args = append(args, arg)
+			arg = make([]ppToken, 0)
+			continue
+		}
+		arg = append(arg, t)
+	}
+
+	err = fmt.Errorf("%s: unterminated argument list invoking macro %q", name.Position, m.Name)
+	return
+}
+
+// checkArgs checks the number of arguments of an invocation.
+func checkArgs(m *macro, args *[][]ppToken, name ppToken) error {
+	n := len(*args)
+	switch {
+	case len(m.Params) == 0 && n == 1 && len((*args)[0]) == 0:
+		// An empty argument list
+		*args = nil
+		return nil
+
+	case m.Variadic && n == len(m.Params)-1:
+		// The variable arguments may be omitted
+		*args = append(*args, []ppToken{})
+		return nil
+
+	case n == len(m.Params):
+		return nil
+
+	case m.Variadic && n < len(m.Params):
+		return fmt.Errorf("%s: macro %q requires at least %d arguments, but only %d given", name.Position, m.Name, len(m.Params)-1, n)
+	}
+	return fmt.Errorf("%s: macro %q requires %d arguments, but %d given", name.Position, m.Name, len(m.Params), n)
+}
+
+// param returns the index of the parameter named by the token, or -1 if it
+// isn't a parameter.
+func (m *macro) param(t ppToken) int {
+	if t.Type == clex.IdentifierToken {
+		for i, p := range m.Params {
+			if p == t.Text {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// subst returns the tokens of the replacement list with the arguments
+// substituted and any ## operators applied.
+func (e *Expander) subst(m *macro, body []ppToken, args [][]ppToken, name ppToken) (out []ppToken, err error) {
+	isPaste := func(i int) bool { return i >= 0 && i < len(body) && body[i].paste }
+
+	for i := 0; i < len(body); i++ {
+		t := body[i]
+		if i == 0 {
+			t.ws = name.ws
+		}
+
+		switch p := m.param(t); {
+		case t.paste && m.Variadic && i > 0 && body[i-1].Text == "," && m.param(body[i+1]) == len(m.Params)-1:
+			// The GNU extension ", ## __VA_ARGS__" removes the comma if there
+			// are no variable arguments, and otherwise doesn't paste
+			i += 1
+			if va := args[len(args)-1]; len(va) > 0 {
+				out = append(out, withSpace(va, t.ws)...)
+			} else {
+				out = out[:len(out)-1]
+			}
+
+		case m.FunctionLike && !t.paste && (t.Text == "#" || t.Text == "%:"):
+			// Stringize the argument
+			i += 1
+			out = append(out, stringize(args[m.param(body[i])], t.ws, name.Position))
+
+		case p >= 0:
+			arg := args[p]
+			if !isPaste(i-1) && !isPaste(i+1) {
+				// An argument is fully expanded unless an operand of ##
+				arg, err = e.expand(arg)
+				if err != nil {
+					return
+				}
+			}
+			out = append(out, withSpace(arg, t.ws)...)
+
+		case t.Text == "__VA_OPT__" && m.Variadic:
+			// The content is only substituted if there are variable arguments
+			j := matchingParen(body, i+1)
+			if j == -1 {
+				err = fmt.Errorf("%s: unterminated __VA_OPT__ in macro %q", m.NamePos, m.Name)
+				return
+			}
+
+			var va []ppToken
+			va, err = e.expand(args[len(args)-1])
+			if err != nil {
+				return
+			}
+			var content []ppToken
+			if len(va) > 0 {
+				content, err = e.subst(m, body[i+2:j], args, ppToken{ws: t.ws})
+				if err != nil {
+					return
+				}
+			}
+			out = append(out, withSpace(content, t.ws)...)
+			i = j
+
+		default:
+			out = append(out, t)
+		}
+	}
+
+	out, err = pasteTokens(out)
+	if err != nil {
+		return
+	}
+
+	// Positions are those of the invocation
+	for i := range out {
+		out[i].Position = name.Position
+		out[i].End = name.End
+		out[i].expanded = true
+	}
+	return
+}
+
+// matchingParen returns the index of the parenthesis that matches the opening
+// parenthesis at index i, or -1.
+func matchingParen(toks []ppToken, i int) int {
+	if i >= len(toks) || toks[i].Text != "(" {
+		return -1
+	}
+	var depth int
+	for ; i < len(toks); i++ {
+		switch toks[i].Text {
+		case "(":
+			depth += 1
+		case ")":
+			depth -= 1
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// withSpace returns a copy of the tokens with the first preceded by the
+// whitespace, or a placemarker if there are none.
+func withSpace(toks []ppToken, ws string) []ppToken {
+	if len(toks) == 0 {
+		return []ppToken{{ws: ws, placemarker: true}}
+	}
+	toks = append([]ppToken(nil), toks...)
+	toks[0].ws = ws
+	return toks
+}
+
+// withHidden returns the tokens with the union of the hide set and the name
+// added to their hide sets.
+func withHidden(toks []ppToken, hide map[string]bool, name string) []ppToken {
+	for i := range toks {
+		h := make(map[string]bool, len(toks[i].hide)+len(hide)+1)
+		for n := range toks[i].hide {
+			h[n] = true
+		}
+		for n := range hide {
+			h[n] = true
+		}
+		h[name] = true
+		toks[i].hide = h
+	}
+	return toks
+}
+
+// intersect returns the names in both hide sets.
+func intersect(a, b map[string]bool) map[string]bool {
+	h := make(map[string]bool)
+	for n := range a {
+		if b[n] {
+			h[n] = true
+		}
+	}
+	return h
+}
+
+// pasteTokens applies the ## operators and removes any placemarkers.
+func pasteTokens(in []ppToken) (out []ppToken, err error) {
+	out = make([]ppToken, 0, len(in))
+	for i := 0; i < len(in); i++ {
+		t := in[i]
+		if !t.paste || len(out) == 0 || i+1 == len(in) {
+			out = append(out, t)
+			continue
+		}
+
+		l, r := out[len(out)-1], in[i+1]
+		i += 1
+		switch {
+		case l.placemarker:
+			r.ws = l.ws
+			out[len(out)-1] = r
+		case r.placemarker:
+		default:
+			var toks []ppToken
+			toks, err = lexTokens(l.Text + r.Text)
+			if err != nil || len(toks) != 1 || toks[0].Type == clex.CommentToken {
+				err = fmt.Errorf("%s: pasting %q and %q does not give a valid preprocessing token", l.Position, l.Text, r.Text)
+				return
+			}
+			l.Type, l.Text = toks[0].Type, toks[0].Text
+			out[len(out)-1] = l
+		}
+	}
+
+	// Remove the placemarkers, keeping their whitespace
+	var (
+		n  int
+		ws string
+	)
+	for _, t := range out {
+		if t.placemarker {
+			ws += t.ws
+			continue
+		}
+		if ws != "" && t.ws == "" {
+			t.ws = " "
+		}
+		t.paste = false
+		ws = ""
+		out[n] = t
+		n += 1
+	}
+	return out[:n], nil
+}
+
+// stringize returns a string literal of the spelling of the argument, as for
+// the # operator.
+func stringize(arg []ppToken, ws string, pos ctext.Position) ppToken {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i, t := range arg {
+		if i > 0 && t.ws != "" {
+			sb.WriteByte(' ')
+		}
+		if t.Type == clex.StringLiteralToken || t.Type == clex.CharLiteralToken {
+			for j := 0; j < len(t.Text); j++ {
+				if t.Text[j] == '"' || t.Text[j] == '\\' {
+					sb.WriteByte('\\')
+				}
+				sb.WriteByte(t.Text[j])
+			}
+		} else {
+			sb.WriteString(t.Text)
+		}
+	}
+	sb.WriteByte('"')
+
+	return ppToken{
+		Token: clex.Token{Type: clex.StringLiteralToken, Text: sb.String(), Position: pos},
+		ws:    ws,
+	}
+}
+
+// lexTokens splits the text into tokens, with whitespace and comments as the
+// whitespace preceding each token.
+func lexTokens(text string) (toks []ppToken, err error) {
+	s := clex.NewScanner(strings.NewReader(text))
+	var ws string
+	for {
+		tt := s.Next()
+		switch tt {
+		case clex.ErrorToken:
+			err = s.Err()
+			if err == io.EOF {
+				err = nil
+			}
+			return
+
+		case clex.WhitespaceToken, clex.NewlineToken:
+			ws += " "
+
+		default:
+			tok := s.Token()
+			tok.Text = tok.Spelling()
+			toks = append(toks, ppToken{Token: tok, ws: ws})
+			ws = ""
+		}
+	}
+}
+
+// writeTokens writes the tokens with their preceding whitespace, adding a
+// space between any that weren't adjacent in the source and would otherwise
+// form a different token.
+func writeTokens(bw *bufio.Writer, toks []ppToken) (err error) {
+	for i, t := range toks {
+		if t.placemarker {
+			_, err = bw.WriteString(t.ws)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		ws := t.ws
+		prev := toks[max(i-1, 0)]
+		adjacent := !t.expanded && !prev.expanded && t.Position == prev.End
+		if ws == "" && i > 0 && !adjacent && !separate(prev, t) {
+			ws = " "
+		}
+		_, err = bw.WriteString(ws)
+		if err != nil {
+			return
+		}
+		_, err = bw.WriteString(t.Text)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// separate returns true if the tokens are still separate tokens when written
+// without whitespace between them.
+func separate(l, r ppToken) bool {
+	toks, err := lexTokens(l.Text + r.Text)
+	return err == nil && len(toks) > 0 && toks[0].Text == l.Text
+}
+
+// joinSpace returns the whitespace for whitespace and comment tokens, where
+// each comment is replaced by a space and any newlines within it.
+func joinSpace(toks []clex.Token) string {
+	var sb strings.Builder
+	for _, tok := range toks {
+		if tok.Type != clex.CommentToken {
+			sb.WriteString(tok.Text)
+			continue
+		}
+		sb.WriteByte(' ')
+		sb.WriteString(strings.Repeat("\n", strings.Count(tok.Text, "\n")))
+	}
+	return sb.String()
+}
@@ -0,0 +1,175 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmacro
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jlubawy/go-ctext"
+	"github.com/jlubawy/go-ctext/clex"
+)
+
+// A Kind is the kind of reference to an identifier.
+type Kind int
+
+const (
+	// Use is any use of an identifier other than a call or taking its
+	// address, e.g. an object-like macro or passing a function as a pointer.
+	Use Kind = iota
+	// Call is an identifier followed by an opening parenthesis, e.g. an
+	// invocation of a function-like macro.
+	Call
+	// AddressOf is an identifier whose address is taken with the unary '&'
+	// operator.
+	AddressOf
+)
+
+var kindNames = []string{
+	Use:       "use",
+	Call:      "call",
+	AddressOf: "address-of",
+}
+
+func (k Kind) String() string {
+	if k >= 0 && int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (k Kind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// An Identifier is a reference to an identifier within C source code.
+type Identifier struct {
+	Name string         // name of the identifier
+	Kind Kind           // kind of reference
+	Pos  ctext.Position // position of the first byte of the identifier
+	End  ctext.Position // position immediately following the last byte of the identifier
+}
+
+// ScanIdentifiers scans the provided io.Reader for references to identifiers
+// that match the given names, returning any via the provided callback.
+func ScanIdentifiers(r io.Reader, scanFunc func(id Identifier), names ...string) (err error) {
+	return ScanIdentifiersScanner(clex.NewScanner(r), scanFunc, names...)
+}
+
+// ScanIdentifiersString scans the provided string for references to
+// identifiers that match the given names, returning any via the provided
+// callback.
+func ScanIdentifiersString(s string, scanFunc func(id Identifier), names ...string) (err error) {
+	return ScanIdentifiers(strings.NewReader(s), scanFunc, names...)
+}
+
+// ScanIdentifiersScanner is like ScanIdentifiers but reads from the provided
+// scanner, so that its Mode and Filename may be set. Like
+// ScanInvocationsScanner, preprocessor directives are skipped.
+func ScanIdentifiersScanner(s *clex.Scanner, scanFunc func(id Identifier), names ...string) (err error) {
+	want := make(map[string]bool, len(names))
+	for _, name := range names {
+		want[name] = true
+	}
+
+	var (
+		pending     *Identifier // identifier waiting for the following token
+		prev        [2]clex.Token
+		lineStart   = true
+		inDirective bool
+	)
+	for {
+		tt := s.Next()
+		switch tt {
+		case clex.ErrorToken:
+			if pending != nil {
+				scanFunc(*pending)
+			}
+			err = s.Err()
+			if err == io.EOF {
+				err = nil
+			}
+			return
+
+		case clex.WhitespaceToken, clex.CommentToken:
+			continue
+
+		case clex.NewlineToken:
+			lineStart = true
+			inDirective = false
+			continue
+		}
+		tok := s.Token()
+
+		// The token following an identifier determines if it's a call
+		if pending != nil {
+			if tt == clex.PunctuatorToken && tok.Spelling() == "(" {
+				pending.Kind = Call
+			}
+			scanFunc(*pending)
+			pending = nil
+		}
+
+		if lineStart && tt == clex.PunctuatorToken && (tok.Spelling() == "#" || tok.Spelling() == "%:") {
+			inDirective = true
+		}
+		lineStart = false
+		if inDirective {
+			continue
+		}
+
+		if tt == clex.IdentifierToken && want[tok.Spelling()] {
+			pending = &Identifier{
+				Name: tok.Spelling(),
+				Kind: Use,
+				Pos:  tok.Position,
+				End:  tok.End,
+			}
+			if isUnaryAmpersand(prev[1], prev[0]) {
+				pending.Kind = AddressOf
+			}
+		}
+		prev[0], prev[1] = prev[1], tok
+	}
+}
+
+// isUnaryAmpersand returns true if the token is an '&' that takes the address
+// of the following operand, rather than being a bitwise and, based on the
+// token preceding it.
+func isUnaryAmpersand(tok, before clex.Token) bool {
+	if tok.Type != clex.PunctuatorToken || tok.Spelling() != "&" {
+		return false
+	}
+	switch before.Type {
+	case clex.IdentifierToken:
+		// A keyword (e.g. return or sizeof) isn't an operand
+		return keywords[before.Spelling()]
+	case clex.NumberToken, clex.StringLiteralToken, clex.CharLiteralToken:
+		return false
+	case clex.PunctuatorToken:
+		switch before.Spelling() {
+		case ")", "]", ":>", "++", "--":
+			return false
+		}
+	}
+	return true
+}
+
+// keywords are the C keywords (C11 6.4.1), which may precede a unary '&'.
+var keywords = map[string]bool{
+	"auto": true, "break": true, "case": true, "char": true, "const": true,
+	"continue": true, "default": true, "do": true, "double": true, "else": true,
+	"enum": true, "extern": true, "float": true, "for": true, "goto": true,
+	"if": true, "inline": true, "int": true, "long": true, "register": true,
+	"restrict": true, "return": true, "short": true, "signed": true,
+	"sizeof": true, "static": true, "struct": true, "switch": true,
+	"typedef": true, "union": true, "unsigned": true, "void": true,
+	"volatile": true, "while": true, "_Alignas": true, "_Alignof": true,
+	"_Atomic": true, "_Bool": true, "_Complex": true, "_Generic": true,
+	"_Imaginary": true, "_Noreturn": true, "_Static_assert": true,
+	"_Thread_local": true,
+}
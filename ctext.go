@@ -15,6 +15,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/jlubawy/go-ctext/internal"
 )
@@ -30,8 +31,64 @@ const (
 	CommentToken
 	// TextToken is a text token.
 	TextToken
+	// StringLiteralToken is a string literal token, including its quotes
+	// but not any prefix (e.g. L or u8). Only returned in ScanLiterals mode.
+	StringLiteralToken
+	// CharLiteralToken is a character constant token, including its quotes
+	// but not any prefix. Only returned in ScanLiterals mode.
+	CharLiteralToken
+	// LineCommentToken is a single-line comment token (e.g. "// ...").
+	// Only returned in ScanCommentKinds mode.
+	LineCommentToken
+	// BlockCommentToken is a multi-line comment token (e.g. "/* ... */").
+	// Only returned in ScanCommentKinds mode.
+	BlockCommentToken
+	// DirectiveToken is a preprocessor directive token, a logical line
+	// beginning with '#' including any line splices, comments and the
+	// terminating newline. Only returned in ScanDirectives mode.
+	DirectiveToken
 )
 
+var tokenTypeNames = []string{
+	ErrorToken:         "Error",
+	CommentToken:       "Comment",
+	TextToken:          "Text",
+	StringLiteralToken: "StringLiteral",
+	CharLiteralToken:   "CharLiteral",
+	LineCommentToken:   "LineComment",
+	BlockCommentToken:  "BlockComment",
+	DirectiveToken:     "Directive",
+}
+
+func (tt TokenType) String() string {
+	if tt >= 0 && int(tt) < len(tokenTypeNames) {
+		return tokenTypeNames[tt]
+	}
+	return fmt.Sprintf("TokenType(%d)", int(tt))
+}
+
+// IsComment returns true if the token type is any kind of comment.
+func (tt TokenType) IsComment() bool {
+	return tt == CommentToken || tt == LineCommentToken || tt == BlockCommentToken
+}
+
+// MarshalText implements the encoding.TextMarshaler interface, so that token
+// types are encoded by name (e.g. in JSON).
+func (tt TokenType) MarshalText() ([]byte, error) {
+	return []byte(tt.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (tt *TokenType) UnmarshalText(text []byte) error {
+	for i, name := range tokenTypeNames {
+		if name == string(text) {
+			*tt = TokenType(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown token type %q", text)
+}
+
 // A Position is the position within a file.
 type Position struct {
 	Filename string // filename, if any
@@ -56,12 +113,113 @@ func (pos Position) String() string {
 	return s
 }
 
+// A Mode controls how a Scanner interprets its input. Modes may be combined
+// using the bitwise OR operator.
+type Mode uint
+
+const (
+	// NestComments allows multi-line comments to be nested, so that
+	// "/* a /* b */ c */" is a single comment. This is not supported by most
+	// compilers, so by default a multi-line comment ends at the first "*/" as
+	// required by the C standard.
+	NestComments Mode = 1 << iota
+	// CPlusPlus recognizes C++ lexical elements, namely raw string literals
+	// (e.g. R"delim(...)delim") and digit separators (e.g. 1'000'000).
+	CPlusPlus
+	// ScanLiterals returns string literals and character constants as
+	// StringLiteralToken and CharLiteralToken tokens rather than as part of a
+	// TextToken.
+	ScanLiterals
+	// ScanCommentKinds returns single-line and multi-line comments as
+	// LineCommentToken and BlockCommentToken tokens rather than CommentToken.
+	ScanCommentKinds
+	// ScanDirectives returns preprocessor directives as DirectiveToken
+	// tokens rather than as part of a TextToken.
+	ScanDirectives
+)
+
+// A Token is a single token returned by the scanner.
+type Token struct {
+	Type     TokenType // type of the token
+	Text     string    // text of the token
+	Position Position  // position of the first byte of the token
+	End      Position  // position immediately following the last byte of the token
+}
+
+// IsDocComment returns true if the token is a documentation comment as used
+// by tools like Doxygen, i.e. one starting with "/**", "/*!", "///" or "//!".
+// The empty comment "/**/" and banners like "/***" or "////" are not documentation
+// comments.
+func (tok Token) IsDocComment() bool {
+	if !tok.Type.IsComment() || len(tok.Text) < 3 {
+		return false
+	}
+	switch tok.Text[:3] {
+	case "/**":
+		return tok.Text != "/**/" && !strings.HasPrefix(tok.Text, "/***")
+	case "///":
+		return !strings.HasPrefix(tok.Text, "////")
+	case "/*!", "//!":
+		return true
+	}
+	return false
+}
+
+// DirectiveName returns the name of the directive (e.g. "define" for
+// "#define X 1") if the token is a DirectiveToken, otherwise an empty string.
+// The name is also empty for the null directive ("#" on its own).
+func (tok Token) DirectiveName() string {
+	if tok.Type != DirectiveToken {
+		return ""
+	}
+
+	// Skip the '#' and any whitespace, line splices or comments after it
+	text := tok.Text
+	i := strings.IndexByte(text, '#') + 1
+	for i < len(text) {
+		if isSpace(text[i]) {
+			i += 1
+		} else if n := internal.SpliceLen(text[i:]); n > 0 {
+			i += n
+		} else if strings.HasPrefix(text[i:], "/*") {
+			j := strings.Index(text[i+2:], "*/")
+			if j == -1 {
+				return ""
+			}
+			i += 2 + j + 2
+		} else {
+			break
+		}
+	}
+
+	name := make([]byte, 0, 8)
+	for i < len(text) {
+		if internal.IsIdent(text[i]) {
+			name = append(name, text[i])
+			i += 1
+		} else if n := internal.SpliceLen(text[i:]); n > 0 {
+			i += n
+		} else {
+			break
+		}
+	}
+	return string(name)
+}
+
 // A Scanner is used to split a C source file into comment and text tokens for
 // further processing.
 type Scanner struct {
 	// Position is the current position of the scanner within a file.
 	Position
 
+	// End is the position immediately following the most recently scanned
+	// token.
+	End Position
+
+	// Mode controls how the input is interpreted. It may be set before the
+	// first call to Next.
+	Mode Mode
+
 	posCurr Position
 
 	br  *bufio.Reader
@@ -69,10 +227,34 @@ type Scanner struct {
 
 	err error
 
+	tt TokenType // type of the most recent token
+
 	// Should be reset every invocation of Next
 	inStringLiteral bool
+	inCharLiteral   bool
 	mlCommentCount  int
+	mlCommentOpen   int // buffer index of the '*' that last opened a comment
 	inSLComment     bool
+	inLiteralToken  bool   // scanning a StringLiteralToken or CharLiteralToken
+	inRawString     bool   // in a C++ raw string literal, inStringLiteral is also set
+	rawDelimDone    bool   // true once the opening '(' of the raw string is found
+	rawDelim        []byte // delimiter of the raw string, preceded by ')'
+	rawStart        int    // buffer index after the opening '(' of the raw string
+	inDirective     bool   // scanning a DirectiveToken
+
+	// True if only whitespace and comments precede the current byte on its
+	// logical line, so that a '#' would begin a directive.
+	lineStart bool
+
+	// The run of identifier characters preceding the current byte, used to
+	// find string literal prefixes.
+	ident []byte
+
+	// The previous byte after line splicing, its position and its index
+	// within the buffer. Should be reset every invocation of Next.
+	prev      byte
+	prevPos   Position
+	prevIndex int
 }
 
 // NewScanner returns a pointer to a new C source scanner.
@@ -85,6 +267,8 @@ func NewScanner(r io.Reader) *Scanner {
 
 		br:  bufio.NewReader(r),
 		buf: &bytes.Buffer{},
+
+		lineStart: true,
 	}
 }
 
@@ -95,7 +279,14 @@ func (s *Scanner) Err() error {
 }
 
 // Next returns the next token type to be processed.
-func (s *Scanner) Next() (tt TokenType) {
+func (s *Scanner) Next() TokenType {
+	s.tt = s.next()
+	s.End = s.posCurr
+	s.End.Filename = s.Filename
+	return s.tt
+}
+
+func (s *Scanner) next() (tt TokenType) {
 	if s.err != nil {
 		return ErrorToken // return error right away if one already exists
 	}
@@ -110,8 +301,14 @@ func (s *Scanner) Next() (tt TokenType) {
 
 	// Reset scanner fields
 	s.inStringLiteral = false
+	s.inCharLiteral = false
 	s.mlCommentCount = 0
 	s.inSLComment = false
+	s.inRawString = false
+	s.inLiteralToken = false
+	s.inDirective = false
+	s.prev = 0
+	s.prevIndex = -1
 
 	for done := false; !done; {
 		// Peek one character first so we can skip any chars we don't want
@@ -125,8 +322,10 @@ func (s *Scanner) Next() (tt TokenType) {
 					if s.mlCommentCount > 0 {
 						s.err = errors.New("unexpected end of multi-line comment")
 						tt = ErrorToken
+					} else if s.inLiteralToken || s.inDirective {
+						// Return the unterminated literal or directive as is
 					} else if s.inSLComment {
-						tt = TextToken
+						tt = s.commentType(LineCommentToken)
 					} else {
 						tt = TextToken
 					}
@@ -147,20 +346,49 @@ func (s *Scanner) Next() (tt TokenType) {
 		}
 
 		b := bs[0]
+		if b == '\\' && !s.inRawString {
+			if n := s.spliceLen(); n > 0 {
+				// Backslash-newlines are deleted in translation phase 2,
+				// splicing physical lines into a logical line. Keep them in
+				// the token text, but otherwise treat them as if they weren't
+				// there so they can continue comments, or appear between the
+				// two characters of a comment delimiter.
+				if _, s.err = io.CopyN(s.buf, s.br, int64(n)); s.err != nil {
+					return ErrorToken
+				}
+				s.posCurr.Offset += n
+				s.posCurr.Line += 1
+				s.posCurr.Column = 1
+				continue
+			}
+		}
+
+		pos := s.posCurr
+
+		if s.inRawString && !s.rawDelimDone {
+			if b == '(' {
+				s.rawDelimDone = true
+				s.rawStart = s.buf.Len() + 1
+			} else {
+				s.rawDelim = append(s.rawDelim, b)
+			}
+		}
+
 		switch b {
 		case '/':
 			if !s.inSLComment && s.mlCommentCount == 0 {
 				// If not in a comment
 
-				if !s.inStringLiteral {
-					// If not in a string literal check if this is the start
-					// of a single-line comment.
-					lb, ok := internal.LastByte(s.buf)
-					if ok && lb == '/' {
+				if !s.inStringLiteral && !s.inCharLiteral {
+					// If not in a string or character literal check if this
+					// is the start of a single-line comment.
+					if s.prev == '/' {
 						// Check if this is the start of a comment
 						s.inSLComment = true
-						s.Position.Line, s.Position.Column = s.posCurr.Line, s.posCurr.Column-1
-					} else if s.buf.Len() > 0 {
+						if !s.inDirective {
+							s.Position.Line, s.Position.Column = s.prevPos.Line, s.prevPos.Column
+						}
+					} else if s.buf.Len() > 0 && !s.inDirective {
 						// If the buffer is not empty then process the text first
 						tt = TextToken
 						return
@@ -168,13 +396,13 @@ func (s *Scanner) Next() (tt TokenType) {
 				}
 
 			} else if s.mlCommentCount > 0 {
-				// Else if in a multi-line comment
-				lb, ok := internal.LastByte(s.buf)
-				if ok && lb == '*' {
+				// Else if in a multi-line comment, check if this is the end
+				// of it, ignoring the '*' that opened it (e.g. "/*/").
+				if s.prev == '*' && s.prevIndex != s.mlCommentOpen {
 					s.mlCommentCount -= 1
 
-					if s.mlCommentCount == 0 {
-						tt = CommentToken
+					if s.mlCommentCount == 0 && !s.inDirective {
+						tt = s.commentType(BlockCommentToken)
 						done = true
 					}
 				}
@@ -183,35 +411,126 @@ func (s *Scanner) Next() (tt TokenType) {
 			}
 
 		case '*':
-			// Possible start or end of multi-line comment
-			lb, ok := internal.LastByte(s.buf)
-			if ok && lb == '/' {
+			// Possible start of multi-line comment
+			if s.inStringLiteral || s.inCharLiteral || s.inSLComment {
+				break
+			}
+			if s.mlCommentCount > 0 && s.Mode&NestComments == 0 {
+				break // comments don't nest unless requested
+			}
+			if s.prev == '/' {
 				s.mlCommentCount += 1
-				if s.mlCommentCount == 1 {
-					s.Position.Line, s.Position.Column = s.posCurr.Line, s.posCurr.Column-1
+				s.mlCommentOpen = s.buf.Len()
+				if s.mlCommentCount == 1 && !s.inDirective {
+					s.Position.Line, s.Position.Column = s.prevPos.Line, s.prevPos.Column
 				}
 			}
 
 		case '\n':
+			if s.inLiteralToken && !s.inRawString {
+				// Literals cannot span lines, so return an unterminated one
+				// and leave the newline for the next token.
+				return
+			}
+
 			// Increment the line and reset the current column
 			s.posCurr.Line += 1
 			s.posCurr.Column = 0
 
+			// Literals (other than raw strings) cannot span lines, so an
+			// unterminated one ends here (e.g. an apostrophe in an #error
+			// directive).
+			s.inCharLiteral = false
+			if !s.inRawString {
+				s.inStringLiteral = false
+			}
+
 			if s.mlCommentCount > 0 {
 				// If in a multi-line comment then continue processing
+			} else if s.inDirective {
+				// Else the end of the logical line is the end of the
+				// directive, including any single-line comment
+				s.inSLComment = false
+				done = true
 			} else if s.inSLComment {
 				s.inSLComment = false
-				tt = CommentToken
+				tt = s.commentType(LineCommentToken)
 				done = true
 			}
 
 		case '"':
-			if !s.inSLComment && s.mlCommentCount == 0 {
-				lb, ok := internal.LastByte(s.buf)
-				if ok && lb != '\\' {
-					s.inStringLiteral = !s.inStringLiteral
+			if !s.inSLComment && s.mlCommentCount == 0 && !s.inCharLiteral {
+				if s.inRawString {
+					// Raw strings have no escapes and only end with the
+					// closing delimiter.
+					if s.rawDelimDone && bytes.HasSuffix(s.buf.Bytes()[s.rawStart:], s.rawDelim) {
+						s.inRawString = false
+						s.inStringLiteral = false
+						done = s.inLiteralToken
+					}
+				} else if !s.inStringLiteral {
+					if s.Mode&ScanLiterals != 0 && !s.inDirective {
+						if s.buf.Len() > 0 {
+							// If the buffer is not empty then process the
+							// text first
+							tt = TextToken
+							return
+						}
+						s.inLiteralToken = true
+						tt = StringLiteralToken
+					}
+					s.inStringLiteral = true
+					if s.Mode&CPlusPlus != 0 && internal.IsRawStringPrefix(s.ident) {
+						s.inRawString = true
+						s.rawDelimDone = false
+						s.rawDelim = append(s.rawDelim[:0], ')')
+					}
+				} else if !internal.IsEscaped(s.buf) {
+					s.inStringLiteral = false
+					done = s.inLiteralToken
+				}
+			}
+
+		case '\'':
+			// Character constants may contain quotes and slashes (e.g. '"',
+			// '/' or '\''), so track them to avoid misinterpreting either.
+			if !s.inSLComment && s.mlCommentCount == 0 && !s.inStringLiteral {
+				if s.Mode&CPlusPlus != 0 && len(s.ident) > 0 && internal.IsDigit(s.ident[0]) {
+					break // a digit separator within a number
+				}
+				if !s.inCharLiteral {
+					if s.Mode&ScanLiterals != 0 && !s.inDirective {
+						if s.buf.Len() > 0 {
+							// If the buffer is not empty then process the
+							// text first
+							tt = TextToken
+							return
+						}
+						s.inLiteralToken = true
+						tt = CharLiteralToken
+					}
+					s.inCharLiteral = true
+				} else if !internal.IsEscaped(s.buf) {
+					s.inCharLiteral = false
+					done = s.inLiteralToken
 				}
 			}
+
+		case '#':
+			// Possible start of a directive
+			if s.Mode&ScanDirectives == 0 || !s.lineStart || s.inDirective {
+				break
+			}
+			if s.inStringLiteral || s.inCharLiteral || s.inSLComment || s.mlCommentCount > 0 {
+				break
+			}
+			if s.buf.Len() > 0 {
+				// If the buffer is not empty then process the text first
+				tt = TextToken
+				return
+			}
+			s.inDirective = true
+			tt = DirectiveToken
 		}
 
 		b, s.err = s.br.ReadByte()
@@ -227,24 +546,142 @@ func (s *Scanner) Next() (tt TokenType) {
 		if s.err != nil {
 			return ErrorToken
 		}
+
+		s.prev, s.prevPos, s.prevIndex = b, pos, s.buf.Len()-1
+
+		if internal.IsIdent(b) && !s.inStringLiteral && !s.inCharLiteral && !s.inSLComment && s.mlCommentCount == 0 {
+			s.ident = append(s.ident, b)
+		} else {
+			s.ident = s.ident[:0]
+		}
+
+		if b == '\n' && s.mlCommentCount == 0 {
+			s.lineStart = true
+		} else if !isSpace(b) && b != '/' && !s.inSLComment && s.mlCommentCount == 0 {
+			// A '/' may be the start of a comment, if it isn't then the
+			// next byte will clear this anyway.
+			s.lineStart = false
+		}
 	}
 
 	return
 }
 
+// commentType returns the given comment token type if in ScanCommentKinds
+// mode, otherwise CommentToken.
+func (s *Scanner) commentType(tt TokenType) TokenType {
+	if s.Mode&ScanCommentKinds != 0 {
+		return tt
+	}
+	return CommentToken
+}
+
+// spliceLen returns the length of the backslash-newline sequence at the start
+// of the unread input, or zero if there isn't one.
+func (s *Scanner) spliceLen() int {
+	bs, _ := s.br.Peek(3)
+	return internal.SpliceLen(string(bs))
+}
+
+// isSpace returns true if the byte is whitespace other than a newline.
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\v' || b == '\f' || b == '\r'
+}
+
 // TokenText returns the string corresponding to the most recently scanned
 // token. Valid after calling Scan().
 func (s *Scanner) TokenText() string {
 	return s.buf.String()
 }
 
+// Token returns the most recently scanned token. Valid after calling Next().
+func (s *Scanner) Token() Token {
+	return Token{
+		Type:     s.tt,
+		Text:     s.TokenText(),
+		Position: s.Position,
+		End:      s.End,
+	}
+}
+
 // StripComments strips all comments from the given io.Reader and writes the
 // resulting output to the io.Writer, returning and error if any.
 func StripComments(w io.Writer, r io.Reader) (err error) {
+	return StripCommentsScanner(w, NewScanner(r))
+}
+
+// StripCommentsScanner is like StripComments but reads from the provided
+// scanner, so that its Mode (e.g. CPlusPlus) may be set. Directives returned
+// in ScanDirectives mode are written with their comments stripped.
+func StripCommentsScanner(w io.Writer, s *Scanner) (err error) {
+	return StripCommentsWithOptions(w, s, StripOptions{})
+}
+
+// A Replacement determines what a stripped comment is replaced with.
+type Replacement int
+
+const (
+	// ReplaceNewlines replaces a comment with only the newlines within it,
+	// preserving line numbers. This is the default.
+	ReplaceNewlines Replacement = iota
+	// ReplaceSpace replaces a comment with a single space, as a compiler
+	// does in translation phase 3.
+	ReplaceSpace
+	// ReplaceWhitespace replaces each byte of a comment with a space, other
+	// than tabs and newlines, preserving line numbers, columns and byte
+	// offsets.
+	ReplaceWhitespace
+	// ReplaceNothing removes a comment entirely.
+	ReplaceNothing
+)
+
+var replacementNames = []string{
+	ReplaceNewlines:   "newlines",
+	ReplaceSpace:      "space",
+	ReplaceWhitespace: "whitespace",
+	ReplaceNothing:    "nothing",
+}
+
+func (rep Replacement) String() string {
+	if rep >= 0 && int(rep) < len(replacementNames) {
+		return replacementNames[rep]
+	}
+	return fmt.Sprintf("Replacement(%d)", int(rep))
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (rep Replacement) MarshalText() ([]byte, error) {
+	return []byte(rep.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (rep *Replacement) UnmarshalText(text []byte) error {
+	for i, name := range replacementNames {
+		if name == string(text) {
+			*rep = Replacement(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown replacement %q", text)
+}
+
+// StripOptions are the options used by StripCommentsWithOptions.
+type StripOptions struct {
+	// Replacement is what each comment is replaced with. The newline ending
+	// a single-line comment isn't part of the comment so it is always kept.
+	Replacement Replacement
+
+	// Keep, if not nil, is called with each comment token and its position.
+	// The comment is written unchanged if it returns true.
+	Keep func(tok Token) bool
+}
+
+// StripCommentsWithOptions is like StripCommentsScanner but replaces comments
+// as specified by the options.
+func StripCommentsWithOptions(w io.Writer, s *Scanner, opts StripOptions) (err error) {
 	bw := bufio.NewWriter(w)
 	defer bw.Flush()
 
-	s := NewScanner(r)
 	for {
 		tt := s.Next()
 		switch tt {
@@ -252,28 +689,79 @@ func StripComments(w io.Writer, r io.Reader) (err error) {
 			err = s.Err()
 			if err == io.EOF {
 				err = nil
-				return
 			}
+			return
 
-		case CommentToken:
-			comment := s.TokenText()
-			for i := 0; i < len(comment); i++ {
-				c := comment[i]
-				if c == '\r' || c == '\n' {
-					err = bw.WriteByte(c)
-					if err != nil {
-						return
-					}
-				}
+		case CommentToken, LineCommentToken, BlockCommentToken:
+			if opts.Keep != nil && opts.Keep(s.Token()) {
+				_, err = bw.WriteString(s.TokenText())
+			} else {
+				err = writeReplacement(bw, s.TokenText(), opts.Replacement)
+			}
+			if err != nil {
+				return
 			}
 
-		case TextToken:
+		case TextToken, StringLiteralToken, CharLiteralToken:
 			_, err = bw.WriteString(s.TokenText())
 			if err != nil {
 				return
 			}
+
+		case DirectiveToken:
+			err = stripDirectiveComments(bw, s.Token(), s.Mode, opts)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// stripDirectiveComments strips the comments within a directive token by
+// scanning its text again without ScanDirectives, starting at its position.
+func stripDirectiveComments(bw *bufio.Writer, tok Token, mode Mode, opts StripOptions) error {
+	s := NewScanner(strings.NewReader(tok.Text))
+	s.Mode = mode &^ ScanDirectives
+	s.Filename = tok.Position.Filename
+	s.posCurr = tok.Position
+	return StripCommentsWithOptions(bw, s, opts)
+}
+
+// writeReplacement writes the replacement for a comment.
+func writeReplacement(bw *bufio.Writer, comment string, rep Replacement) (err error) {
+	if rep == ReplaceNewlines || rep == ReplaceWhitespace {
+		for i := 0; i < len(comment); i++ {
+			c := comment[i]
+			switch {
+			case c == '\r' || c == '\n':
+			case rep == ReplaceNewlines:
+				continue
+			case c != '\t':
+				c = ' '
+			}
+			err = bw.WriteByte(c)
+			if err != nil {
+				return
+			}
 		}
+		return
 	}
 
+	// Keep the newline ending a single-line comment
+	var newline string
+	if strings.HasPrefix(comment, "//") {
+		if strings.HasSuffix(comment, "\r\n") {
+			newline = "\r\n"
+		} else if strings.HasSuffix(comment, "\n") {
+			newline = "\n"
+		}
+	}
+	if rep == ReplaceSpace {
+		err = bw.WriteByte(' ')
+		if err != nil {
+			return
+		}
+	}
+	_, err = bw.WriteString(newline)
 	return
 }
@@ -0,0 +1,110 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/jlubawy/go-cli"
+	"github.com/jlubawy/go-ctext"
+	"github.com/jlubawy/go-ctext/cmacro"
+)
+
+type CheckOptions struct {
+	FileOptions
+	CPP     bool
+	Defines namesFlag
+	Imacros namesFlag
+	Arities string
+}
+
+var checkOptions CheckOptions
+
+var checkCommand = cli.Command{
+	Name:             "check",
+	ShortDescription: "check the number of arguments of macro invocations in C source files",
+	Description: `Checks that the invocations of function-like macros in C source files have the
+number of arguments required by their definitions, printing each that doesn't
+and exiting with a non-zero status if there are any. For example, as a
+pre-commit hook:
+
+    ctext check -imacros include/log.h src
+
+The macros are those given by the -D flags (see "ctext help expand"), the files
+named by the -imacros flags and the file named by the -arities flag, as well as
+those defined by #define directives within each file, which apply to the
+invocations following them until any #undef. The -arities file lists the
+arities of macros one per line as a name and number of arguments, followed by
+a '+' if more may be given, with lines starting with '#' ignored:
+
+    # name    arity
+    LOG       1+
+    REGISTER  2
+
+` + filesDescription,
+	ShortUsage: "[-output output | -outdir dir] [-include globs] [-exclude globs] [-jobs n] [-cpp] [-D name[=body]...] [-imacros file...] [-arities file] [source files or directories]",
+	SetupFlags: func(fs *flag.FlagSet) {
+		checkOptions.FileOptions.SetupFlags(fs)
+		fs.BoolVar(&checkOptions.CPP, "cpp", false, "scan the source as C++ (default for C++ file extensions)")
+		fs.Var(&checkOptions.Defines, "D", "define a macro as name or name=body (may be repeated)")
+		fs.Var(&checkOptions.Imacros, "imacros", "file to read macro definitions from (may be repeated)")
+		fs.StringVar(&checkOptions.Arities, "arities", "", "file to read the arities of macros from")
+	},
+	Run: func(args []string) {
+		defs, err := predefinedMacros(checkOptions.Imacros, checkOptions.Defines, checkOptions.CPP)
+		if err != nil {
+			cli.Fatalf("Error reading macro definitions: %v\n", err)
+		}
+
+		var arities []byte
+		if checkOptions.Arities != "" {
+			arities, err = os.ReadFile(checkOptions.Arities)
+			if err == nil {
+				err = cmacro.NewValidator().ReadArities(bytes.NewReader(arities))
+			}
+			if err != nil {
+				cli.Fatalf("Error reading -arities file: %v\n", err)
+			}
+		}
+
+		var count int64
+		err = processFiles(args, checkOptions.FileOptions, func(w io.Writer, r io.Reader, f sourceFile) (err error) {
+			v := cmacro.NewValidator()
+			for _, def := range defs {
+				v.Define(def)
+			}
+			err = v.ReadArities(bytes.NewReader(arities))
+			if err != nil {
+				return
+			}
+
+			s := ctext.NewScanner(r)
+			s.Filename = f.Path
+			s.Mode = f.Mode(checkOptions.CPP)
+			var werr error
+			err = v.Validate(s, func(aerr *cmacro.ArityError) {
+				atomic.AddInt64(&count, 1)
+				if werr == nil {
+					_, werr = fmt.Fprintln(w, aerr)
+				}
+			})
+			if err == nil {
+				err = werr
+			}
+			return
+		})
+		if err != nil {
+			cli.Fatalf("Error checking macros: %v\n", err)
+		}
+		if count > 0 {
+			cli.Fatalf("Found %d macro invocations with the wrong number of arguments.\n", count)
+		}
+	},
+}
@@ -0,0 +1,191 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jlubawy/go-cli"
+	"github.com/jlubawy/go-ctext"
+)
+
+type CommentsOptions struct {
+	FileOptions
+	CPP    bool
+	Format string
+	Kind   string
+	Regexp string
+}
+
+var commentsOptions CommentsOptions
+
+var commentsCommand = cli.Command{
+	Name:             "comments",
+	ShortDescription: "print the comments in C source files",
+	Description: `Prints the comments in C source files along with their positions.
+
+` + filesDescription + `
+
+` + formatsDescription + `
+
+The -kind flag selects the kinds of comments to print as a comma-separated list
+of line, block and doc (e.g. "-kind doc" for documentation comments only), and
+the -regexp flag selects comments matching a regular expression. For example to
+print the TODO and FIXME comments:
+
+    ctext comments -regexp 'TODO|FIXME' foo.c`,
+	ShortUsage: "[-output output | -outdir dir] [-include globs] [-exclude globs] [-jobs n] [-cpp] [-format format] [-kind kinds] [-regexp regexp] [source files or directories]",
+	SetupFlags: func(fs *flag.FlagSet) {
+		commentsOptions.FileOptions.SetupFlags(fs)
+		fs.BoolVar(&commentsOptions.CPP, "cpp", false, "scan the source as C++ (default for C++ file extensions)")
+		fs.StringVar(&commentsOptions.Format, "format", "plain", "output format: plain, json or csv")
+		fs.StringVar(&commentsOptions.Kind, "kind", "", "comma-separated kinds of comments to print: line, block or doc (default all)")
+		fs.StringVar(&commentsOptions.Regexp, "regexp", "", "only print comments matching the regular expression")
+	},
+	Run: func(args []string) {
+		filter, err := newCommentFilter(commentsOptions.Kind, commentsOptions.Regexp)
+		if err != nil {
+			cli.Fatalf("Error parsing flags: %v\n", err)
+		}
+		if _, err := newRecordWriter(io.Discard, commentsOptions.Format, nil); err != nil {
+			cli.Fatalf("Error parsing -format flag: %v\n", err)
+		}
+
+		err = processFiles(args, commentsOptions.FileOptions, func(w io.Writer, r io.Reader, f sourceFile) error {
+			s := ctext.NewScanner(r)
+			s.Filename = f.Path
+			s.Mode = f.Mode(commentsOptions.CPP) | ctext.ScanCommentKinds
+
+			// Only write a CSV header at the start of each output
+			var header []string
+			if f.First {
+				header = commentHeader
+			}
+			rw, _ := newRecordWriter(w, commentsOptions.Format, header)
+			return writeComments(rw, s, filter)
+		})
+		if err != nil {
+			cli.Fatalf("Error printing comments: %v\n", err)
+		}
+	},
+}
+
+// A comment is a comment as printed by the comments command.
+type comment struct {
+	Filename string `json:"filename,omitempty"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Offset   int    `json:"offset"`
+	Kind     string `json:"kind"`
+	Doc      bool   `json:"doc"`
+	Text     string `json:"text"`
+}
+
+// commentHeader is the CSV header for comments.
+var commentHeader = []string{"filename", "line", "column", "offset", "kind", "doc", "text"}
+
+func (c comment) String() string {
+	pos := ctext.Position{Filename: c.Filename, Offset: c.Offset, Line: c.Line, Column: c.Column}
+	return fmt.Sprintf("%s: %s", pos, c.Text)
+}
+
+func (c comment) Fields() []string {
+	return []string{
+		c.Filename,
+		strconv.Itoa(c.Line),
+		strconv.Itoa(c.Column),
+		strconv.Itoa(c.Offset),
+		c.Kind,
+		strconv.FormatBool(c.Doc),
+		c.Text,
+	}
+}
+
+func newComment(tok ctext.Token) comment {
+	c := comment{
+		Filename: tok.Position.Filename,
+		Line:     tok.Position.Line,
+		Column:   tok.Position.Column,
+		Offset:   tok.Position.Offset,
+		Kind:     "block",
+		Doc:      tok.IsDocComment(),
+		Text:     tok.Text,
+	}
+	if tok.Type == ctext.LineCommentToken {
+		// The newline ending the comment isn't part of it
+		c.Kind = "line"
+		c.Text = strings.TrimSuffix(c.Text, "\n")
+		c.Text = strings.TrimSuffix(c.Text, "\r")
+	}
+	return c
+}
+
+// commentFilter selects comments by kind and regular expression.
+type commentFilter struct {
+	line, block, doc bool
+	re               *regexp.Regexp
+}
+
+func newCommentFilter(kinds, expr string) (f *commentFilter, err error) {
+	f = &commentFilter{}
+	if kinds == "" {
+		f.line, f.block = true, true
+	} else {
+		for _, kind := range strings.Split(kinds, ",") {
+			switch strings.TrimSpace(kind) {
+			case "line":
+				f.line = true
+			case "block":
+				f.block = true
+			case "doc":
+				f.doc = true
+			default:
+				err = fmt.Errorf("unknown comment kind %q", kind)
+				return
+			}
+		}
+	}
+	if expr != "" {
+		f.re, err = regexp.Compile(expr)
+	}
+	return
+}
+
+func (f *commentFilter) match(c comment) bool {
+	if !(c.Kind == "line" && f.line || c.Kind == "block" && f.block || c.Doc && f.doc) {
+		return false
+	}
+	return f.re == nil || f.re.MatchString(c.Text)
+}
+
+// writeComments writes the comments read from the scanner that match the
+// filter.
+func writeComments(rw recordWriter, s *ctext.Scanner, f *commentFilter) (err error) {
+	for {
+		tt := s.Next()
+		if tt == ctext.ErrorToken {
+			err = s.Err()
+			if err == io.EOF {
+				err = rw.Flush()
+			}
+			return
+		}
+		if !tt.IsComment() {
+			continue
+		}
+		c := newComment(s.Token())
+		if f.match(c) {
+			err = rw.Write(c)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jlubawy/go-cli"
+	"github.com/jlubawy/go-ctext/clex"
+	"github.com/jlubawy/go-ctext/cmacro"
+)
+
+type ExpandOptions struct {
+	FileOptions
+	CPP     bool
+	Defines namesFlag
+	Imacros namesFlag
+}
+
+var expandOptions ExpandOptions
+
+var expandCommand = cli.Command{
+	Name:             "expand",
+	ShortDescription: "expand the macros in C source files",
+	Description: `Expands the macro invocations in C source files using the macros defined by
+#define directives within each file, as well as those given by the -D flags and
+the files named by the -imacros flags. For example, to see what the LOG macros
+in foo.c expand to given the definitions in log.h:
+
+    ctext expand -imacros log.h -D NDEBUG foo.c
+
+Each -D flag defines a macro as for a compiler, either "name" which defines it
+as 1, or "name=body" where the name may include a parameter list (e.g.
+"-D 'MAX(a,b)=((a)>(b)?(a):(b))'").
+
+The #define and #undef directives are replaced by empty lines, and comments by
+a space. Other directives such as #include and #if aren't processed and are
+written unchanged.
+
+` + filesDescription,
+	ShortUsage: "[-output output | -outdir dir] [-include globs] [-exclude globs] [-jobs n] [-cpp] [-D name[=body]...] [-imacros file...] [source files or directories]",
+	SetupFlags: func(fs *flag.FlagSet) {
+		expandOptions.FileOptions.SetupFlags(fs)
+		fs.BoolVar(&expandOptions.CPP, "cpp", false, "scan the source as C++ (default for C++ file extensions)")
+		fs.Var(&expandOptions.Defines, "D", "define a macro as name or name=body (may be repeated)")
+		fs.Var(&expandOptions.Imacros, "imacros", "file to read macro definitions from (may be repeated)")
+	},
+	Run: func(args []string) {
+		defs, err := predefinedMacros(expandOptions.Imacros, expandOptions.Defines, expandOptions.CPP)
+		if err != nil {
+			cli.Fatalf("Error reading macro definitions: %v\n", err)
+		}
+
+		err = processFiles(args, expandOptions.FileOptions, func(w io.Writer, r io.Reader, f sourceFile) (err error) {
+			e := cmacro.NewExpander()
+			for _, def := range defs {
+				err = e.Define(def)
+				if err != nil {
+					return
+				}
+			}
+
+			s := clex.NewScanner(r)
+			s.Filename = f.Path
+			s.Mode = f.Mode(expandOptions.CPP)
+			return e.Expand(w, s)
+		})
+		if err != nil {
+			cli.Fatalf("Error expanding macros: %v\n", err)
+		}
+	},
+}
+
+// predefinedMacros returns the definitions within the named files followed by
+// those given by -D flags. The files are scanned as C++ if cpp is true or they
+// have a C++ file extension.
+func predefinedMacros(files []string, defines []string, cpp bool) (defs []cmacro.Definition, err error) {
+	scanFunc := func(def cmacro.Definition) { defs = append(defs, def) }
+
+	for _, name := range files {
+		err = scanDefinitionsFile(name, cpp, scanFunc)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, define := range defines {
+		name, body, ok := strings.Cut(define, "=")
+		if !ok {
+			body = "1"
+		}
+
+		n := len(defs)
+		err = cmacro.ScanDefinitionsString("#define "+name+" "+body, scanFunc)
+		if err == nil && len(defs) != n+1 {
+			err = fmt.Errorf("invalid definition")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("-D %s: %v", define, err)
+		}
+	}
+	return
+}
+
+// scanDefinitionsFile scans the named file for macro definitions, as C++ if
+// cpp is true or it has a C++ file extension.
+func scanDefinitionsFile(name string, cpp bool, scanFunc func(def cmacro.Definition)) (err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	s := clex.NewScanner(f)
+	s.Filename = name
+	s.Mode = sourceFile{Path: name}.Mode(cpp)
+	return cmacro.ScanDefinitionsScanner(s, scanFunc)
+}
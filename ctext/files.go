@@ -0,0 +1,359 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/jlubawy/go-ctext"
+)
+
+// FileOptions are the options shared by the commands that process source
+// files.
+type FileOptions struct {
+	Output  string
+	Outdir  string
+	Include string
+	Exclude string
+	Jobs    int
+
+	// InPlace and Backup are only used by commands that rewrite source files.
+	InPlace bool
+	Backup  string
+}
+
+// SetupFlags adds the file options to the flag set.
+func (opts *FileOptions) SetupFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.Output, "output", "", "output file or stdout if empty")
+	fs.StringVar(&opts.Outdir, "outdir", "", "write the output for each source file to a mirrored tree in this directory")
+	fs.StringVar(&opts.Include, "include", defaultInclude, "comma-separated globs of the files to process within directories")
+	fs.StringVar(&opts.Exclude, "exclude", "", "comma-separated globs of the files and directories to skip within directories")
+	fs.IntVar(&opts.Jobs, "jobs", runtime.NumCPU(), "number of files to process concurrently")
+}
+
+// SetupInPlaceFlags adds the options for rewriting source files in place to
+// the flag set.
+func (opts *FileOptions) SetupInPlaceFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&opts.InPlace, "inplace", false, "rewrite each source file in place")
+	fs.StringVar(&opts.Backup, "backup", "", "when rewriting in place, keep a copy of each source file with this suffix (e.g. .orig)")
+}
+
+// defaultInclude are the globs of the files processed within directories by
+// default, the C and C++ source and header files (see isCPlusPlusFile).
+const defaultInclude = "*.c,*.h,*.cc,*.cpp,*.cxx,*.c++,*.hh,*.hpp,*.hxx,*.h++"
+
+// filesDescription describes the file arguments and options in the
+// description of a command.
+const filesDescription = `Any number of source files and directories may be provided, or if none are then
+the source is read from stdin. Directories are walked recursively for the files
+matching the -include globs (by default C and C++ source and header files, such
+as *.c, *.h, *.cpp and *.hpp) and not matching the -exclude globs. Files with
+C++ extensions are scanned as C++. The files are processed concurrently, and
+their output is written in order to -output, or to a mirror of the source tree
+within -outdir.`
+
+// A sourceFile is a source file to be processed.
+type sourceFile struct {
+	Path  string // path of the file, empty for stdin
+	Rel   string // path of the output file relative to -outdir
+	First bool   // true if this is the first file written to its output
+}
+
+// Mode returns the scanner mode for the file, which is C++ if forced or the
+// file has a C++ file extension.
+func (f sourceFile) Mode(cpp bool) (mode ctext.Mode) {
+	if cpp || isCPlusPlusFile(f.Path) {
+		mode |= ctext.CPlusPlus
+	}
+	return
+}
+
+// processFunc processes a source file read from r, writing the output to w.
+type processFunc func(w io.Writer, r io.Reader, f sourceFile) error
+
+// processFiles processes the source files and directories given as arguments,
+// or stdin if there are none, returning the first error if any.
+func processFiles(args []string, opts FileOptions, fn processFunc) (err error) {
+	if opts.InPlace && (opts.Output != "" || opts.Outdir != "") {
+		return fmt.Errorf("-inplace can't be used with -output or -outdir")
+	}
+	if opts.Backup != "" && !opts.InPlace {
+		return fmt.Errorf("-backup requires -inplace")
+	}
+
+	if len(args) == 0 {
+		if opts.Outdir != "" || opts.InPlace {
+			return fmt.Errorf("-outdir and -inplace require source files")
+		}
+		return writeOutput(opts.Output, 0664, func(w io.Writer) error {
+			return fn(w, os.Stdin, sourceFile{First: true})
+		})
+	}
+
+	var files []sourceFile
+	files, err = findFiles(args, opts)
+	if err != nil {
+		return
+	}
+	if opts.Outdir != "" || opts.InPlace {
+		for i := range files {
+			files[i].First = true
+		}
+	} else if len(files) > 0 {
+		files[0].First = true
+	}
+
+	// Process the files concurrently, buffering the output of each unless
+	// writing to -outdir
+	var (
+		jobs chan struct{}
+		done = make([]chan struct{}, len(files))
+		bufs = make([]*bytes.Buffer, len(files))
+		errs = make([]error, len(files))
+	)
+	if opts.Jobs > 1 {
+		jobs = make(chan struct{}, opts.Jobs)
+	} else {
+		jobs = make(chan struct{}, 1)
+	}
+	for i := range files {
+		done[i] = make(chan struct{})
+		bufs[i] = &bytes.Buffer{}
+	}
+	go func() {
+		for i := range files {
+			jobs <- struct{}{}
+			go func(i int) {
+				defer close(done[i])
+				defer func() { <-jobs }()
+
+				f := files[i]
+				if opts.InPlace {
+					errs[i] = processFileInPlace(f, opts.Backup, fn)
+				} else if opts.Outdir != "" {
+					errs[i] = processFile(filepath.Join(opts.Outdir, f.Rel), f, fn)
+				} else {
+					errs[i] = processFileTo(bufs[i], f, fn)
+				}
+			}(i)
+		}
+	}()
+
+	waitFor := func(i int) error {
+		<-done[i]
+		return errs[i]
+	}
+
+	if opts.Outdir != "" || opts.InPlace {
+		for i := range files {
+			if ferr := waitFor(i); ferr != nil && err == nil {
+				err = ferr
+			}
+		}
+		return
+	}
+
+	return writeOutput(opts.Output, 0664, func(w io.Writer) (err error) {
+		for i := range files {
+			if ferr := waitFor(i); ferr != nil {
+				if err == nil {
+					err = ferr
+				}
+				continue
+			}
+			if err == nil {
+				_, err = bufs[i].WriteTo(w)
+			}
+			bufs[i] = nil
+		}
+		return
+	})
+}
+
+// processFile processes a source file, writing the output to the named file.
+func processFile(name string, f sourceFile, fn processFunc) (err error) {
+	err = os.MkdirAll(filepath.Dir(name), 0775)
+	if err != nil {
+		return
+	}
+	return writeOutput(name, 0664, func(w io.Writer) error {
+		return processFileTo(w, f, fn)
+	})
+}
+
+// processFileInPlace processes a source file, replacing it with the output.
+// The output is written to a temporary file which is renamed over the source
+// file, so that the source file is never left partially written. If the backup
+// suffix isn't empty then a copy of the source file is kept.
+func processFileInPlace(f sourceFile, backup string, fn processFunc) (err error) {
+	fi, err := os.Stat(f.Path)
+	if err != nil {
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.Path), "."+filepath.Base(f.Path)+".*.tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	err = processFileTo(tmp, f, fn)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+	err = os.Chmod(tmp.Name(), fi.Mode().Perm())
+	if err != nil {
+		return
+	}
+
+	if backup != "" {
+		err = copyFile(f.Path+backup, f.Path, fi.Mode().Perm())
+		if err != nil {
+			return
+		}
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// copyFile copies the source file to the destination file.
+func copyFile(dst, src string, perm os.FileMode) (err error) {
+	r, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	return writeOutput(dst, perm, func(w io.Writer) (err error) {
+		_, err = io.Copy(w, r)
+		return
+	})
+}
+
+// processFileTo processes a source file, writing the output to w.
+func processFileTo(w io.Writer, f sourceFile, fn processFunc) (err error) {
+	r, err := os.Open(f.Path)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	err = fn(w, r, f)
+	if err != nil {
+		err = fmt.Errorf("%s: %v", f.Path, err)
+	}
+	return
+}
+
+// writeOutput calls fn with the named output file, or stdout if the name is
+// empty. The file is created with the permissions, or truncated if it exists.
+func writeOutput(name string, perm os.FileMode, fn func(w io.Writer) error) (err error) {
+	if name == "" {
+		return fn(os.Stdout)
+	}
+
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return
+	}
+	err = fn(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return
+}
+
+// findFiles returns the source files given as arguments, walking any
+// directories for the files matching the include and exclude globs.
+func findFiles(args []string, opts FileOptions) (files []sourceFile, err error) {
+	var (
+		include = splitGlobs(opts.Include)
+		exclude = splitGlobs(opts.Exclude)
+	)
+	for _, arg := range args {
+		var fi os.FileInfo
+		fi, err = os.Stat(arg)
+		if err != nil {
+			return
+		}
+
+		if !fi.IsDir() {
+			// Files named explicitly are always processed
+			files = append(files, sourceFile{Path: arg, Rel: outputRel(arg)})
+			continue
+		}
+
+		err = filepath.Walk(arg, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != arg && matchGlobs(exclude, path) {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if fi.Mode().IsRegular() && matchGlobs(include, path) {
+				rel, err := filepath.Rel(arg, path)
+				if err != nil {
+					return err
+				}
+				files = append(files, sourceFile{Path: path, Rel: rel})
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// outputRel returns the path of the output for a file named explicitly,
+// which mirrors the path if it is relative and within the current directory.
+func outputRel(path string) string {
+	path = filepath.Clean(path)
+	if filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+		return filepath.Base(path)
+	}
+	return path
+}
+
+// splitGlobs splits a comma-separated list of globs.
+func splitGlobs(s string) (globs []string) {
+	for _, glob := range strings.Split(s, ",") {
+		if glob = strings.TrimSpace(glob); glob != "" {
+			globs = append(globs, glob)
+		}
+	}
+	return
+}
+
+// matchGlobs returns true if the base name of the path, or the path itself,
+// matches any of the globs.
+func matchGlobs(globs []string, path string) bool {
+	for _, glob := range globs {
+		if ok, _ := filepath.Match(glob, filepath.Base(path)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(glob, filepath.ToSlash(path)); ok {
+			return true
+		}
+	}
+	return false
+}
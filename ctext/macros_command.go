@@ -0,0 +1,150 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jlubawy/go-cli"
+	"github.com/jlubawy/go-ctext"
+	"github.com/jlubawy/go-ctext/cmacro"
+)
+
+type MacrosOptions struct {
+	FileOptions
+	CPP    bool
+	Format string
+	Names  namesFlag
+}
+
+var macrosOptions MacrosOptions
+
+var macrosCommand = cli.Command{
+	Name:             "macros",
+	ShortDescription: "print the invocations of macros in C source files",
+	Description: `Prints the invocations of the function-like macros named by the -name flags in
+C source files, along with the lines they start and end on and their arguments.
+For example:
+
+    ctext macros -name LOG_ERROR -name ASSERT src
+
+` + filesDescription + `
+
+` + formatsDescription + `
+
+In the plain format each invocation is prefixed with its filename and the lines
+it starts and ends on (e.g. "foo.c:3-5: LOG( a, b );").`,
+	ShortUsage: "-name name [-name name...] [-output output | -outdir dir] [-include globs] [-exclude globs] [-jobs n] [-cpp] [-format format] [source files or directories]",
+	SetupFlags: func(fs *flag.FlagSet) {
+		macrosOptions.FileOptions.SetupFlags(fs)
+		fs.BoolVar(&macrosOptions.CPP, "cpp", false, "scan the source as C++ (default for C++ file extensions)")
+		fs.StringVar(&macrosOptions.Format, "format", "plain", "output format: plain, json or csv")
+		fs.Var(&macrosOptions.Names, "name", "name of a macro to print the invocations of (may be repeated)")
+	},
+	Run: func(args []string) {
+		if len(macrosOptions.Names) == 0 {
+			cli.Fatal("At least one -name flag is required.\n")
+		}
+		if _, err := newRecordWriter(io.Discard, macrosOptions.Format, nil); err != nil {
+			cli.Fatalf("Error parsing -format flag: %v\n", err)
+		}
+
+		err := processFiles(args, macrosOptions.FileOptions, func(w io.Writer, r io.Reader, f sourceFile) (err error) {
+			s := ctext.NewScanner(r)
+			s.Filename = f.Path
+			s.Mode = f.Mode(macrosOptions.CPP)
+
+			// Only write a CSV header at the start of each output
+			var header []string
+			if f.First {
+				header = invocationHeader
+			}
+			rw, _ := newRecordWriter(w, macrosOptions.Format, header)
+			var werr error
+			err = cmacro.ScanInvocationsScanner(s, func(inv cmacro.Invocation) {
+				if werr == nil {
+					werr = rw.Write(newInvocation(inv))
+				}
+			}, macrosOptions.Names...)
+			if err == nil {
+				err = werr
+			}
+			if ferr := rw.Flush(); err == nil {
+				err = ferr
+			}
+			return
+		})
+		if err != nil {
+			cli.Fatalf("Error printing macros: %v\n", err)
+		}
+	},
+}
+
+// namesFlag is a flag that may be repeated to give a list of names.
+type namesFlag []string
+
+func (names *namesFlag) String() string { return strings.Join(*names, ",") }
+
+func (names *namesFlag) Set(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty name")
+	}
+	*names = append(*names, name)
+	return nil
+}
+
+// An invocation is a macro invocation as printed by the macros command.
+type invocation struct {
+	Filename string   `json:"filename,omitempty"`
+	Start    int      `json:"start"`
+	Column   int      `json:"column"`
+	End      int      `json:"end"`
+	Name     string   `json:"name"`
+	Args     []string `json:"args"`
+	Follow   string   `json:"follow"`
+
+	inv cmacro.Invocation
+}
+
+// invocationHeader is the CSV header for invocations. The arguments are
+// joined by ", " as in Invocation.String, without any empty arguments.
+var invocationHeader = []string{"filename", "start", "column", "end", "name", "nargs", "args", "follow"}
+
+func newInvocation(inv cmacro.Invocation) invocation {
+	return invocation{
+		Filename: inv.Pos.Filename,
+		Start:    inv.Start,
+		Column:   inv.Pos.Column,
+		End:      inv.End,
+		Name:     inv.Name,
+		Args:     inv.Args,
+		Follow:   inv.Follow,
+		inv:      inv,
+	}
+}
+
+// String returns the invocation prefixed with the filename and the lines it
+// starts and ends on (e.g. "foo.c:3-5: LOG( a, b );").
+func (inv invocation) String() string {
+	pos := ctext.Position{Filename: inv.Filename}
+	return fmt.Sprintf("%s:%d-%d: %s", pos, inv.Start, inv.End, inv.inv)
+}
+
+func (inv invocation) Fields() []string {
+	return []string{
+		inv.Filename,
+		strconv.Itoa(inv.Start),
+		strconv.Itoa(inv.Column),
+		strconv.Itoa(inv.End),
+		inv.Name,
+		strconv.Itoa(len(inv.Args)),
+		strings.Join(inv.Args, ", "),
+		inv.Follow,
+	}
+}
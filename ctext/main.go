@@ -17,6 +17,10 @@ var program = cli.Program{
 	Name:        "ctext",
 	Description: "Ctext is a program for manipulating C source code.",
 	Commands: []cli.Command{
+		checkCommand,
+		commentsCommand,
+		expandCommand,
+		macrosCommand,
 		stripCommand,
 	},
 }
@@ -0,0 +1,94 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// formatsDescription describes the -format flag in the description of a
+// command.
+const formatsDescription = `The -format flag selects the output format:
+
+    plain  one result per line prefixed with its position (default)
+    json   one JSON object per line (JSON Lines)
+    csv    comma-separated values with a header row`
+
+// A record is a result printed by a command, such as a comment.
+type record interface {
+	String() string   // plain text
+	Fields() []string // CSV fields, in the order of the header
+}
+
+// A recordWriter writes records in one of the output formats.
+type recordWriter interface {
+	Write(rec record) error
+	Flush() error
+}
+
+// newRecordWriter returns a writer for the format. The CSV header is only
+// written if it isn't nil.
+func newRecordWriter(w io.Writer, format string, header []string) (recordWriter, error) {
+	switch format {
+	case "plain":
+		return &plainRecordWriter{w: w}, nil
+	case "json":
+		return &jsonRecordWriter{enc: json.NewEncoder(w)}, nil
+	case "csv":
+		return &csvRecordWriter{w: csv.NewWriter(w), header: header}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+type plainRecordWriter struct {
+	w io.Writer
+}
+
+func (pw *plainRecordWriter) Write(rec record) (err error) {
+	_, err = fmt.Fprintln(pw.w, rec)
+	return
+}
+
+func (pw *plainRecordWriter) Flush() error { return nil }
+
+type jsonRecordWriter struct {
+	enc *json.Encoder
+}
+
+func (jw *jsonRecordWriter) Write(rec record) error { return jw.enc.Encode(rec) }
+
+func (jw *jsonRecordWriter) Flush() error { return nil }
+
+type csvRecordWriter struct {
+	w      *csv.Writer
+	header []string // header to write before the next record
+}
+
+func (cw *csvRecordWriter) writeHeader() (err error) {
+	if cw.header != nil {
+		err = cw.w.Write(cw.header)
+		cw.header = nil
+	}
+	return
+}
+
+func (cw *csvRecordWriter) Write(rec record) (err error) {
+	err = cw.writeHeader()
+	if err != nil {
+		return
+	}
+	return cw.w.Write(rec.Fields())
+}
+
+func (cw *csvRecordWriter) Flush() error {
+	if err := cw.writeHeader(); err != nil {
+		return err
+	}
+	cw.w.Flush()
+	return cw.w.Error()
+}
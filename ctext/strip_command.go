@@ -7,56 +7,111 @@ package main
 import (
 	"flag"
 	"io"
-	"os"
+	"path/filepath"
+	"regexp"
 
 	"github.com/jlubawy/go-cli"
 	"github.com/jlubawy/go-ctext"
 )
 
 type StripOptions struct {
-	Output string
+	FileOptions
+	CPP        bool
+	Replace    string
+	KeepRegexp string
+	KeepFirst  bool
+	KeepDoc    bool
 }
 
 var stripOptions StripOptions
 
 var stripCommand = cli.Command{
 	Name:             "strip",
-	ShortDescription: "strip comments from a C source file",
-	Description: `Strips comments from a C source file. If a file is not provided then the source
-is read from stdin.`,
-	ShortUsage: "[-output output] [source file]",
+	ShortDescription: "strip comments from C source files",
+	Description: `Strips comments from C source files.
+
+` + filesDescription + `
+
+By default each comment is replaced with the newlines within it, preserving line
+numbers. The -replace flag selects another replacement:
+
+    newlines    only the newlines within the comment (default)
+    space       a single space, as a compiler does
+    whitespace  spaces of the same length, preserving columns and byte offsets
+    nothing     remove the comment entirely
+
+Comments may be kept as is using the -keep-regexp, -keep-first and -keep-doc
+flags, for example to keep a license banner and documentation comments:
+
+    ctext strip -keep-first -keep-doc foo.h
+
+The -inplace flag rewrites each source file with its comments stripped, keeping
+a copy of the original if a -backup suffix is given:
+
+    ctext strip -inplace -backup .orig src`,
+	ShortUsage: "[-output output | -outdir dir | -inplace [-backup suffix]] [-include globs] [-exclude globs] [-jobs n] [-cpp] [-replace replacement] [-keep-regexp regexp] [-keep-first] [-keep-doc] [source files or directories]",
 	SetupFlags: func(fs *flag.FlagSet) {
-		fs.StringVar(&stripOptions.Output, "output", "", "output file or stdout if empty")
+		stripOptions.FileOptions.SetupFlags(fs)
+		stripOptions.FileOptions.SetupInPlaceFlags(fs)
+		fs.BoolVar(&stripOptions.CPP, "cpp", false, "scan the source as C++ (default for C++ file extensions)")
+		fs.StringVar(&stripOptions.Replace, "replace", "newlines", "what to replace comments with: newlines, space, whitespace or nothing")
+		fs.StringVar(&stripOptions.KeepRegexp, "keep-regexp", "", "keep comments matching the regular expression")
+		fs.BoolVar(&stripOptions.KeepFirst, "keep-first", false, "keep the first comment in the file (e.g. a license banner)")
+		fs.BoolVar(&stripOptions.KeepDoc, "keep-doc", false, "keep documentation comments (e.g. /** ... */ or ///)")
 	},
 	Run: func(args []string) {
-		var r io.Reader
-		if len(args) == 0 {
-			r = os.Stdin
-		} else if len(args) == 1 {
-			f, err := os.OpenFile(args[0], os.O_RDONLY, 0664)
-			if err != nil {
-				cli.Fatalf("Error opening input file: %v\n", err)
-			}
-			defer f.Close()
-			r = f
-		} else {
-			cli.Fatal("Expected a single input file.\n")
+		var opts ctext.StripOptions
+		if err := opts.Replacement.UnmarshalText([]byte(stripOptions.Replace)); err != nil {
+			cli.Fatalf("Error parsing -replace flag: %v\n", err)
 		}
 
-		var w io.Writer
-		if stripOptions.Output == "" {
-			w = os.Stdout
-		} else {
-			f, err := os.OpenFile(stripOptions.Output, os.O_CREATE|os.O_WRONLY, 0664)
+		var re *regexp.Regexp
+		if stripOptions.KeepRegexp != "" {
+			var err error
+			re, err = regexp.Compile(stripOptions.KeepRegexp)
 			if err != nil {
-				cli.Fatalf("Error opening output file: %v\n", err)
+				cli.Fatalf("Error parsing -keep-regexp flag: %v\n", err)
 			}
-			defer f.Close()
-			w = f
 		}
 
-		if err := ctext.StripComments(w, r); err != nil {
+		err := processFiles(args, stripOptions.FileOptions, func(w io.Writer, r io.Reader, f sourceFile) error {
+			s := ctext.NewScanner(r)
+			s.Filename = f.Path
+			s.Mode = f.Mode(stripOptions.CPP)
+
+			opts := opts
+			opts.Keep = stripKeepFunc(stripOptions, re)
+			return ctext.StripCommentsWithOptions(w, s, opts)
+		})
+		if err != nil {
 			cli.Fatalf("Error stripping comments: %v\n", err)
 		}
 	},
 }
+
+// stripKeepFunc returns a function that keeps the comments of a file selected
+// by the options, or nil if all comments are to be stripped.
+func stripKeepFunc(opts StripOptions, re *regexp.Regexp) func(tok ctext.Token) bool {
+	if re == nil && !opts.KeepFirst && !opts.KeepDoc {
+		return nil
+	}
+
+	first := true
+	return func(tok ctext.Token) bool {
+		isFirst := first
+		first = false
+		return (opts.KeepFirst && isFirst) ||
+			(opts.KeepDoc && tok.IsDocComment()) ||
+			(re != nil && re.MatchString(tok.Text))
+	}
+}
+
+// isCPlusPlusFile returns true if the filename has a C++ source or header
+// file extension.
+func isCPlusPlusFile(filename string) bool {
+	switch filepath.Ext(filename) {
+	case ".cc", ".cpp", ".cxx", ".c++", ".hh", ".hpp", ".hxx", ".h++":
+		return true
+	}
+	return false
+}
@@ -6,6 +6,7 @@ package ctext
 
 import (
 	"bytes"
+	"encoding/json"
 	"io"
 	"reflect"
 	"strings"
@@ -19,10 +20,12 @@ type expected struct {
 
 func TestOffsets(t *testing.T) {
 	var cases = []struct {
+		Mode     Mode
 		Lines    []string
 		Expected []expected
 	}{
 		{
+			Mode: NestComments,
 			Lines: []string{
 				``,
 				`#include <stdio.h>`,
@@ -71,6 +74,192 @@ func TestOffsets(t *testing.T) {
 				{TextToken, Position{"", 531, 27, 78}},
 			},
 		},
+		{
+			Lines: []string{
+				`static const char punct[] = { '"', '/', '*', '\'', '\\' }; // table`,
+				`int c = L'x' + u'/' + U'*' + 'ab'; /* '"' */`,
+				`if ( c == '"' ) { /* quote */ }`,
+			},
+			Expected: []expected{
+				{TextToken, Position{"", 0, 1, 1}},
+				{CommentToken, Position{"", 59, 1, 60}},
+				{TextToken, Position{"", 68, 2, 1}},
+				{CommentToken, Position{"", 103, 2, 36}},
+				{TextToken, Position{"", 112, 2, 45}},
+				{CommentToken, Position{"", 131, 3, 19}},
+				{TextToken, Position{"", 142, 3, 30}},
+			},
+		},
+		{
+			Lines: []string{
+				`const char *path = "C:\\"; // windows`,
+				`const char *re = "\\d+\\/*"; /* comment */`,
+				`puts( "\"" ); // quote`,
+				``,
+			},
+			Expected: []expected{
+				{TextToken, Position{"", 0, 1, 1}},
+				{CommentToken, Position{"", 27, 1, 28}},
+				{TextToken, Position{"", 38, 2, 1}},
+				{CommentToken, Position{"", 67, 2, 30}},
+				{TextToken, Position{"", 80, 2, 43}},
+				{CommentToken, Position{"", 95, 3, 15}},
+			},
+		},
+		{
+			// The backslash before the splice escapes the quote after it
+			Lines: []string{
+				`s = "a\\`,
+				`" // not a comment"; // c`,
+			},
+			Expected: []expected{
+				{TextToken, Position{"", 0, 1, 1}},
+				{CommentToken, Position{"", 30, 2, 22}},
+			},
+		},
+		{
+			Lines: []string{
+				`/* a /* b */ code */`,
+				`/*/ still a comment */ x; // c /* d`,
+				`y;`,
+			},
+			Expected: []expected{
+				{CommentToken, Position{"", 0, 1, 1}},
+				{TextToken, Position{"", 12, 1, 13}},
+				{TextToken, Position{"", 19, 1, 20}},
+				{CommentToken, Position{"", 21, 2, 1}},
+				{TextToken, Position{"", 43, 2, 23}},
+				{CommentToken, Position{"", 47, 2, 27}},
+				{TextToken, Position{"", 57, 3, 1}},
+			},
+		},
+		{
+			Mode: NestComments,
+			Lines: []string{
+				`/* a /* b */ code */`,
+				`/*/ still a comment */ x; // c /* d`,
+				`y;`,
+			},
+			Expected: []expected{
+				{CommentToken, Position{"", 0, 1, 1}},
+				{TextToken, Position{"", 20, 1, 21}},
+				{CommentToken, Position{"", 21, 2, 1}},
+				{TextToken, Position{"", 43, 2, 23}},
+				{CommentToken, Position{"", 47, 2, 27}},
+				{TextToken, Position{"", 57, 3, 1}},
+			},
+		},
+		{
+			Lines: []string{
+				`#define X 1 // comment \`,
+				`  still comment`,
+				`a /\`,
+				`* block */ b;`,
+				`c "str\`,
+				`ing // x"; // \` + "\r",
+				`comment`,
+				``,
+			},
+			Expected: []expected{
+				{TextToken, Position{"", 0, 1, 1}},
+				{CommentToken, Position{"", 12, 1, 13}},
+				{TextToken, Position{"", 41, 3, 1}},
+				{CommentToken, Position{"", 43, 3, 3}},
+				{TextToken, Position{"", 56, 4, 11}},
+				{CommentToken, Position{"", 79, 6, 12}},
+			},
+		},
+		{
+			Mode: CPlusPlus,
+			Lines: []string{
+				`auto a = R"(// not a comment)"; // comment`,
+				`auto b = u8R"x(a )" /* b */ )x"; /* c */`,
+				`auto c = 1'000'000; // d`,
+				`auto d = LR"(`,
+				`/* e */ \`,
+				`)"; auto e = u8"f\"/*"; // g`,
+				``,
+			},
+			Expected: []expected{
+				{TextToken, Position{"", 0, 1, 1}},
+				{CommentToken, Position{"", 32, 1, 33}},
+				{TextToken, Position{"", 43, 2, 1}},
+				{CommentToken, Position{"", 76, 2, 34}},
+				{TextToken, Position{"", 83, 2, 41}},
+				{CommentToken, Position{"", 104, 3, 21}},
+				{TextToken, Position{"", 109, 4, 1}},
+				{CommentToken, Position{"", 157, 6, 25}},
+			},
+		},
+		{
+			Mode: ScanLiterals | CPlusPlus,
+			Lines: []string{
+				`puts( "Hello /* world */" ); // "not a literal"`,
+				`char c = L'\'', d = '"';`,
+				`const char *e = "unterminated`,
+				`auto f = R"x(raw "string")x";`,
+				``,
+			},
+			Expected: []expected{
+				{TextToken, Position{"", 0, 1, 1}},
+				{StringLiteralToken, Position{"", 6, 1, 7}},
+				{TextToken, Position{"", 25, 1, 26}},
+				{CommentToken, Position{"", 29, 1, 30}},
+				{TextToken, Position{"", 48, 2, 1}},
+				{CharLiteralToken, Position{"", 58, 2, 11}},
+				{TextToken, Position{"", 62, 2, 15}},
+				{CharLiteralToken, Position{"", 68, 2, 21}},
+				{TextToken, Position{"", 71, 2, 24}},
+				{StringLiteralToken, Position{"", 89, 3, 17}},
+				{TextToken, Position{"", 102, 3, 30}},
+				{StringLiteralToken, Position{"", 113, 4, 11}},
+				{TextToken, Position{"", 131, 4, 29}},
+			},
+		},
+		{
+			Mode: ScanCommentKinds,
+			Lines: []string{
+				`/* block */ a; // line`,
+				`b; /* multi`,
+				`line */ c; // at eof`,
+				`// no newline`,
+			},
+			Expected: []expected{
+				{BlockCommentToken, Position{"", 0, 1, 1}},
+				{TextToken, Position{"", 11, 1, 12}},
+				{LineCommentToken, Position{"", 15, 1, 16}},
+				{TextToken, Position{"", 23, 2, 1}},
+				{BlockCommentToken, Position{"", 26, 2, 4}},
+				{TextToken, Position{"", 42, 3, 8}},
+				{LineCommentToken, Position{"", 46, 3, 12}},
+				{LineCommentToken, Position{"", 56, 4, 1}},
+			},
+		},
+		{
+			Mode: ScanDirectives,
+			Lines: []string{
+				`#include <sys/types.h> // types`,
+				`  # /* c */ define PUTS( _s ) { \`,
+				`    fputs( _s, "#stdout" ); /* multi`,
+				`    line */ \`,
+				`}`,
+				`int a = b # c;`,
+				`/* lead */ #if defined( X )`,
+				`#`,
+				`#endif`,
+			},
+			Expected: []expected{
+				{DirectiveToken, Position{"", 0, 1, 1}},
+				{TextToken, Position{"", 32, 2, 1}},
+				{DirectiveToken, Position{"", 34, 2, 3}},
+				{TextToken, Position{"", 119, 6, 1}},
+				{CommentToken, Position{"", 134, 7, 1}},
+				{TextToken, Position{"", 144, 7, 11}},
+				{DirectiveToken, Position{"", 145, 7, 12}},
+				{DirectiveToken, Position{"", 162, 8, 1}},
+				{DirectiveToken, Position{"", 164, 9, 1}},
+			},
+		},
 	}
 
 	for i, tc := range cases {
@@ -78,6 +267,7 @@ func TestOffsets(t *testing.T) {
 		actual := make([]expected, 0)
 
 		s := NewScanner(strings.NewReader(strings.Join(tc.Lines, "\n")))
+		s.Mode = tc.Mode
 		for {
 			tt := s.Next()
 			switch tt {
@@ -109,6 +299,124 @@ func TestOffsets(t *testing.T) {
 	}
 }
 
+func TestToken(t *testing.T) {
+	var input = "a /* b */\n// c\n"
+
+	var expected = []Token{
+		{TextToken, "a ", Position{"test.c", 0, 1, 1}, Position{"test.c", 2, 1, 3}},
+		{CommentToken, "/* b */", Position{"test.c", 2, 1, 3}, Position{"test.c", 9, 1, 10}},
+		{TextToken, "\n", Position{"test.c", 9, 1, 10}, Position{"test.c", 10, 2, 1}},
+		{CommentToken, "// c\n", Position{"test.c", 10, 2, 1}, Position{"test.c", 15, 3, 1}},
+	}
+
+	actual := make([]Token, 0)
+	s := NewScanner(strings.NewReader(input))
+	s.Filename = "test.c"
+	for {
+		tt := s.Next()
+		if tt == ErrorToken {
+			if err := s.Err(); err != io.EOF {
+				t.Fatal(err)
+			}
+			break
+		}
+		actual = append(actual, s.Token())
+	}
+
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("%+v", expected)
+		t.Errorf("%+v", actual)
+	}
+
+	// Tokens should survive a round trip through JSON
+	bs, err := json.Marshal(actual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := make([]Token, 0)
+	if err := json.Unmarshal(bs, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, decoded) {
+		t.Errorf("%+v", actual)
+		t.Errorf("%+v", decoded)
+	}
+}
+
+func TestEnd(t *testing.T) {
+	var input = "#define A /* a */ \\\r\n  1\r\n" +
+		"x = \"abc\ny; // b\n" +
+		"/* c\n */"
+
+	var expected = []Position{
+		{"", 26, 3, 1},
+		{"", 30, 3, 5},
+		{"", 34, 3, 9},
+		{"", 38, 4, 4},
+		{"", 43, 5, 1},
+		{"", 51, 6, 4},
+	}
+
+	actual := make([]Position, 0)
+	s := NewScanner(strings.NewReader(input))
+	s.Mode = ScanLiterals | ScanDirectives
+	for {
+		tt := s.Next()
+		if tt == ErrorToken {
+			if err := s.Err(); err != io.EOF {
+				t.Fatal(err)
+			}
+			break
+		}
+		actual = append(actual, s.End)
+	}
+
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("%+v", expected)
+		t.Errorf("%+v", actual)
+	}
+}
+
+func TestDirectiveName(t *testing.T) {
+	var cases = []struct {
+		Input string
+		Name  string
+	}{
+		{
+			Input: "#include <stdio.h>\n",
+			Name:  "include",
+		},
+		{
+			Input: "#  /* comment */ define X 1\n",
+			Name:  "define",
+		},
+		{
+			Input: "# \\\n  if\\\ndef X\n",
+			Name:  "ifdef",
+		},
+		{
+			Input: "#\n",
+			Name:  "",
+		},
+		{
+			Input: "#endif // X",
+			Name:  "endif",
+		},
+	}
+
+	for i, tc := range cases {
+		s := NewScanner(strings.NewReader(tc.Input))
+		s.Mode = ScanDirectives
+		if tt := s.Next(); tt != DirectiveToken {
+			t.Errorf("%d: expected %s but got %s", i, DirectiveToken, tt)
+			continue
+		}
+		if name := s.Token().DirectiveName(); name != tc.Name {
+			t.Errorf("%d: expected %q but got %q", i, tc.Name, name)
+		}
+	}
+}
+
 func TestStripComments(t *testing.T) {
 	var input = strings.Join([]string{
 		`/**`,
@@ -156,3 +464,134 @@ func TestStripComments(t *testing.T) {
 		t.Errorf("%q", actual)
 	}
 }
+
+func TestStripCommentsWithOptions(t *testing.T) {
+	var input = "a/**/b = c; // d\n\t/* e\n */ f;\r\n// g\r\nh"
+
+	var cases = []struct {
+		Replacement Replacement
+		Expected    string
+	}{
+		{ReplaceNewlines, "ab = c; \n\t\n f;\r\n\r\nh"},
+		{ReplaceSpace, "a b = c;  \n\t  f;\r\n \r\nh"},
+		{ReplaceWhitespace, "a    b = c;     \n\t    \n    f;\r\n    \r\nh"},
+		{ReplaceNothing, "ab = c; \n\t f;\r\n\r\nh"},
+	}
+
+	for _, tc := range cases {
+		buf := &bytes.Buffer{}
+		s := NewScanner(strings.NewReader(input))
+		if err := StripCommentsWithOptions(buf, s, StripOptions{Replacement: tc.Replacement}); err != nil {
+			t.Fatal(err)
+		}
+		if actual := buf.String(); actual != tc.Expected {
+			t.Errorf("%v: expected %q but got %q", tc.Replacement, tc.Expected, actual)
+		}
+		if tc.Replacement == ReplaceWhitespace && len(input) != buf.Len() {
+			t.Errorf("%v: expected length %d but got %d", tc.Replacement, len(input), buf.Len())
+		}
+	}
+
+	// An error other than io.EOF must be returned
+	err := StripCommentsWithOptions(&bytes.Buffer{}, NewScanner(strings.NewReader("a /* b")), StripOptions{})
+	if err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestReplacement(t *testing.T) {
+	for rep := ReplaceNewlines; rep <= ReplaceNothing; rep++ {
+		bs, err := rep.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var actual Replacement
+		if err := actual.UnmarshalText(bs); err != nil {
+			t.Fatal(err)
+		}
+		if actual != rep {
+			t.Errorf("expected %v but got %v", rep, actual)
+		}
+	}
+	var rep Replacement
+	if err := rep.UnmarshalText([]byte("bogus")); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestIsDocComment(t *testing.T) {
+	var cases = []struct {
+		Token    Token
+		Expected bool
+	}{
+		{Token{Type: BlockCommentToken, Text: "/** doc */"}, true},
+		{Token{Type: BlockCommentToken, Text: "/*! doc */"}, true},
+		{Token{Type: LineCommentToken, Text: "/// doc\n"}, true},
+		{Token{Type: CommentToken, Text: "//! doc\n"}, true},
+		{Token{Type: BlockCommentToken, Text: "/* not doc */"}, false},
+		{Token{Type: BlockCommentToken, Text: "/**/"}, false},
+		{Token{Type: BlockCommentToken, Text: "/*****\n * banner\n *****/"}, false},
+		{Token{Type: LineCommentToken, Text: "//////////\n"}, false},
+		{Token{Type: TextToken, Text: "/// not a comment"}, false},
+	}
+
+	for _, tc := range cases {
+		if actual := tc.Token.IsDocComment(); actual != tc.Expected {
+			t.Errorf("%q: expected %t but got %t", tc.Token.Text, tc.Expected, actual)
+		}
+	}
+}
+
+func TestStripCommentsKeep(t *testing.T) {
+	var (
+		input    = "/* License */\n/** Doc */\nint a; // TODO\n"
+		expected = "/* License */\n/** Doc */\nint a; \n"
+	)
+
+	var lines []int
+	opts := StripOptions{
+		Keep: func(tok Token) bool {
+			lines = append(lines, tok.Position.Line)
+			return tok.Position.Line == 1 || tok.IsDocComment()
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := StripCommentsWithOptions(buf, NewScanner(strings.NewReader(input)), opts); err != nil {
+		t.Fatal(err)
+	}
+	if actual := buf.String(); actual != expected {
+		t.Errorf("expected %q but got %q", expected, actual)
+	}
+	if !reflect.DeepEqual(lines, []int{1, 2, 3}) {
+		t.Errorf("expected comments on lines [1 2 3] but got %v", lines)
+	}
+}
+
+func TestStripCommentsDirectives(t *testing.T) {
+	var (
+		input    = "#include <a.h> // c\n#define A /* d */ 1 /** e */\nint x; // f\n"
+		expected = "#include <a.h> \n#define A  1 /** e */\nint x; \n"
+	)
+
+	var lines []int
+	opts := StripOptions{
+		Keep: func(tok Token) bool {
+			lines = append(lines, tok.Position.Line)
+			return tok.IsDocComment()
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	s := NewScanner(strings.NewReader(input))
+	s.Mode = ScanDirectives | ScanCommentKinds
+	if err := StripCommentsWithOptions(buf, s, opts); err != nil {
+		t.Fatal(err)
+	}
+	if actual := buf.String(); actual != expected {
+		t.Errorf("expected %q but got %q", expected, actual)
+	}
+	if !reflect.DeepEqual(lines, []int{1, 2, 2, 3}) {
+		t.Errorf("expected comments on lines [1 2 2 3] but got %v", lines)
+	}
+}
@@ -46,6 +46,7 @@ main( void )
 func Example_complex() {
 	s := ctext.NewScanner(strings.NewReader(ComplexProgram))
 	s.Filename = "hello_world.c"
+	s.Mode = ctext.NestComments // allow the nested comment at the end
 	for {
 		tt := s.Next()
 
@@ -2,6 +2,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+//go:build ignore
 // +build ignore
 
 // This command is used to generate the JSON file used in testing.
@@ -12,7 +13,6 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 
@@ -41,26 +41,13 @@ func main() {
 	tokens := make([]ctext.Token, 0)
 	s := ctext.NewScanner(f)
 	s.Filename = file
-	for {
-		tt := s.Next()
-
-		switch tt {
-		case ctext.ErrorToken:
-			err := s.Err()
-			if err == io.EOF {
-				goto DONE
-			}
+	for tok, err := range s.All() {
+		if err != nil {
 			fatalf("Error scanning file: %v\n", err)
-
-		case ctext.CommentToken:
-			tokens = append(tokens, s.Token())
-
-		case ctext.TextToken:
-			tokens = append(tokens, s.Token())
 		}
+		tokens = append(tokens, tok)
 	}
 
-DONE:
 	enc := json.NewEncoder(os.Stdout)
 	enc.SetIndent("", "  ")
 	if err := enc.Encode(&tokens); err != nil {
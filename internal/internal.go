@@ -6,6 +6,7 @@ package internal
 
 import (
 	"bytes"
+	"strings"
 )
 
 // LastByte returns the last byte in a byte.Buffer, ok is false if the length
@@ -22,3 +23,76 @@ func LastByte(buf *bytes.Buffer) (b byte, ok bool) {
 	b = bs[ln-1]
 	return
 }
+
+// IsEscaped returns true if the next byte written to the buffer would be
+// escaped, that is if the buffer ends in an odd number of consecutive
+// backslashes. Line splices are skipped since they are removed before escape
+// sequences are interpreted.
+func IsEscaped(buf *bytes.Buffer) bool {
+	var (
+		bs = buf.Bytes()
+		n  int
+	)
+	for i := len(bs) - 1; i >= 0; i-- {
+		switch {
+		case bs[i] == '\n' && i > 0 && bs[i-1] == '\\':
+			i -= 1
+		case bs[i] == '\n' && i > 1 && bs[i-1] == '\r' && bs[i-2] == '\\':
+			i -= 2
+		case bs[i] == '\\':
+			n += 1
+		default:
+			return n%2 == 1
+		}
+	}
+	return n%2 == 1
+}
+
+// IsDigit returns true if the byte is a decimal digit.
+func IsDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
+
+// IsIdent returns true if the byte may appear in an identifier.
+func IsIdent(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || IsDigit(b) || b == '_'
+}
+
+// IsRawStringPrefix returns true if the identifier is a C++ raw string
+// literal prefix.
+func IsRawStringPrefix(ident []byte) bool {
+	switch string(ident) {
+	case "R", "LR", "uR", "UR", "u8R":
+		return true
+	}
+	return false
+}
+
+// SpliceLen returns the length of the backslash-newline sequence (a line
+// splice) at the start of s, or zero if there isn't one.
+func SpliceLen(s string) int {
+	if strings.HasPrefix(s, "\\\n") {
+		return 2
+	}
+	if strings.HasPrefix(s, "\\\r\n") {
+		return 3
+	}
+	return 0
+}
+
+// Unsplice returns s with any line splices removed.
+func Unsplice(s string) string {
+	if strings.IndexByte(s, '\\') == -1 {
+		return s
+	}
+	bs := make([]byte, 0, len(s))
+	for i := 0; i < len(s); {
+		if n := SpliceLen(s[i:]); n > 0 {
+			i += n
+			continue
+		}
+		bs = append(bs, s[i])
+		i += 1
+	}
+	return string(bs)
+}
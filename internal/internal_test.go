@@ -44,3 +44,113 @@ func TestLastByte(t *testing.T) {
 		}
 	}
 }
+
+func TestIsEscaped(t *testing.T) {
+	var cases = []struct {
+		Input     string
+		IsEscaped bool
+	}{
+		{
+			Input:     ``,
+			IsEscaped: false,
+		},
+		{
+			Input:     `"abc`,
+			IsEscaped: false,
+		},
+		{
+			Input:     `"abc\`,
+			IsEscaped: true,
+		},
+		{
+			Input:     `"C:\\`,
+			IsEscaped: false,
+		},
+		{
+			Input:     `"\\\`,
+			IsEscaped: true,
+		},
+		{
+			Input:     `\\\\`,
+			IsEscaped: false,
+		},
+		{
+			Input:     "\"a\\\\\n",
+			IsEscaped: true,
+		},
+		{
+			Input:     "\"a\\\\\r\n\\\n",
+			IsEscaped: true,
+		},
+		{
+			Input:     "\"a\\\\\\\n",
+			IsEscaped: false,
+		},
+	}
+
+	for _, tc := range cases {
+		buf := bytes.NewBufferString(tc.Input)
+		if isEscaped := IsEscaped(buf); isEscaped != tc.IsEscaped {
+			t.Errorf("%q: expected %t but got %t", tc.Input, tc.IsEscaped, isEscaped)
+		}
+	}
+}
+
+func TestIsRawStringPrefix(t *testing.T) {
+	var cases = []struct {
+		Input  string
+		Prefix bool
+	}{
+		{Input: "", Prefix: false},
+		{Input: "R", Prefix: true},
+		{Input: "u8R", Prefix: true},
+		{Input: "LR", Prefix: true},
+		{Input: "L", Prefix: false},
+		{Input: "FOOR", Prefix: false},
+	}
+
+	for _, tc := range cases {
+		if prefix := IsRawStringPrefix([]byte(tc.Input)); prefix != tc.Prefix {
+			t.Errorf("%q: expected %t but got %t", tc.Input, tc.Prefix, prefix)
+		}
+	}
+}
+
+func TestSpliceLen(t *testing.T) {
+	var cases = []struct {
+		Input     string
+		SpliceLen int
+	}{
+		{Input: "", SpliceLen: 0},
+		{Input: "\\", SpliceLen: 0},
+		{Input: "\\n", SpliceLen: 0},
+		{Input: "\\\n", SpliceLen: 2},
+		{Input: "\\\r\nabc", SpliceLen: 3},
+		{Input: "a\\\n", SpliceLen: 0},
+	}
+
+	for _, tc := range cases {
+		if n := SpliceLen(tc.Input); n != tc.SpliceLen {
+			t.Errorf("%q: expected %d but got %d", tc.Input, tc.SpliceLen, n)
+		}
+	}
+}
+
+func TestUnsplice(t *testing.T) {
+	var cases = []struct {
+		Input    string
+		Expected string
+	}{
+		{Input: "", Expected: ""},
+		{Input: "abc", Expected: "abc"},
+		{Input: "in\\\nclude", Expected: "include"},
+		{Input: "a\\\r\nb\\\nc", Expected: "abc"},
+		{Input: "a\\b", Expected: "a\\b"},
+	}
+
+	for _, tc := range cases {
+		if s := Unsplice(tc.Input); s != tc.Expected {
+			t.Errorf("%q: expected %q but got %q", tc.Input, tc.Expected, s)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+// +build go1.23
+
+package ctext
+
+import (
+	"io"
+	"iter"
+)
+
+// All returns an iterator over the remaining tokens of the scanner, so that
+// they may be ranged over:
+//
+//	for tok, err := range s.All() {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// Iteration stops at the end of the input. Any other error is yielded once
+// with an ErrorToken before iteration stops.
+func (s *Scanner) All() iter.Seq2[Token, error] {
+	return func(yield func(Token, error) bool) {
+		for {
+			if s.Next() == ErrorToken {
+				if err := s.Err(); err != io.EOF {
+					yield(s.Token(), err)
+				}
+				return
+			}
+			if !yield(s.Token(), nil) {
+				return
+			}
+		}
+	}
+}
+
+// Tokens returns an iterator over the tokens read from r using a new scanner
+// with the default mode.
+func Tokens(r io.Reader) iter.Seq2[Token, error] {
+	return NewScanner(r).All()
+}
+
+// Filter returns an iterator over the tokens of seq for which keep returns
+// true. Errors are always passed through.
+func Filter(seq iter.Seq2[Token, error], keep func(tok Token) bool) iter.Seq2[Token, error] {
+	return func(yield func(Token, error) bool) {
+		for tok, err := range seq {
+			if err == nil && !keep(tok) {
+				continue
+			}
+			if !yield(tok, err) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Josh Lubawy. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+// +build go1.23
+
+package ctext
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokens(t *testing.T) {
+	var (
+		input    = "a /* b */ c // d\n"
+		expected = []TokenType{TextToken, CommentToken, TextToken, CommentToken}
+		actual   []TokenType
+	)
+	for tok, err := range Tokens(strings.NewReader(input)) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual = append(actual, tok.Type)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %v but got %v", expected, actual)
+	}
+}
+
+func TestAllError(t *testing.T) {
+	var n int
+	for tok, err := range Tokens(strings.NewReader("a /* b")) {
+		n += 1
+		if n == 1 && (err != nil || tok.Text != "a ") {
+			t.Errorf("unexpected token %+v (%v)", tok, err)
+		}
+		if n == 2 && (err == nil || tok.Type != ErrorToken) {
+			t.Errorf("expected error but got %+v (%v)", tok, err)
+		}
+	}
+	if n != 2 {
+		t.Errorf("expected 2 iterations but got %d", n)
+	}
+}
+
+func TestAllBreak(t *testing.T) {
+	s := NewScanner(strings.NewReader("a /* b */ c"))
+	for range s.All() {
+		break
+	}
+	if tt := s.Next(); tt != CommentToken {
+		t.Errorf("expected scanning to continue with %v but got %v", CommentToken, tt)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	var (
+		input    = "a /* b */ c // d\n"
+		expected = []string{"/* b */", "// d\n"}
+		actual   []string
+	)
+	comments := Filter(Tokens(strings.NewReader(input)), func(tok Token) bool {
+		return tok.Type.IsComment()
+	})
+	for tok, err := range comments {
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual = append(actual, tok.Text)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %q but got %q", expected, actual)
+	}
+
+	// Errors are passed through even if filtered
+	var errs int
+	for _, err := range Filter(Tokens(strings.NewReader("/* a")), func(Token) bool { return false }) {
+		if err != nil {
+			errs += 1
+		}
+	}
+	if errs != 1 {
+		t.Errorf("expected 1 error but got %d", errs)
+	}
+}